@@ -0,0 +1,225 @@
+package main
+
+// Threshold based alerting on mtr reports.
+//
+// Rules come from the config file:
+//
+//   "alerts": {
+//     "topic": "/alerts/mtr",
+//     "rules": [
+//       {"name": "loss", "metric": "loss", "threshold": 10, "clear": 5, "consecutive": 3},
+//       {"name": "latency", "target": "8.8.8.8", "metric": "avg", "threshold": 150},
+//       {"name": "voice", "metric": "mos", "operator": "<", "threshold": 3.6, "clear": 4}
+//     ]
+//   }
+//
+// A rule fires once its metric is beyond the threshold for the given
+// number of consecutive reports, and resolves once it's back beyond the
+// clear value (the threshold when not set) for as many reports.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultAlertTopic = "/alerts/mtr"
+
+type AlertsConfig struct {
+	Topic string       `json:"topic"`
+	Rules []*AlertRule `json:"rules"`
+}
+
+type AlertRule struct {
+	Name string `json:"name"`
+	// only evaluated for reports of this target, all of them when empty
+	Target string `json:"target"`
+	Metric string `json:"metric"`
+	// ">" (default) fires when the metric is above the threshold, "<"
+	// when below
+	Operator    string   `json:"operator"`
+	Threshold   float64  `json:"threshold"`
+	Clear       *float64 `json:"clear"`
+	Consecutive int      `json:"consecutive"`
+}
+
+// Alert state change, sent to the alerts topic
+type Alert struct {
+	Rule      string          `json:"rule"`
+	Target    string          `json:"target"`
+	State     string          `json:"state"`
+	Metric    string          `json:"metric"`
+	Value     float64         `json:"value"`
+	Threshold float64         `json:"threshold"`
+	Time      time.Time       `json:"time"`
+	Location  *ReportLocation `json:"location"`
+}
+
+// Metrics rules can use. All of them but hop-change refer to the last
+// hop in the report, usually the target.
+var alertMetrics = map[string]func(r *Report, prevHops int) float64{
+	"loss":   func(r *Report, _ int) float64 { return lastHop(r).LostPercent },
+	"avg":    func(r *Report, _ int) float64 { return lastHop(r).Avg },
+	"best":   func(r *Report, _ int) float64 { return lastHop(r).Best },
+	"worst":  func(r *Report, _ int) float64 { return lastHop(r).Worst },
+	"stdev":  func(r *Report, _ int) float64 { return lastHop(r).StDev },
+	"p95":    func(r *Report, _ int) float64 { return lastHop(r).P95 },
+	"jitter": func(r *Report, _ int) float64 { return lastHop(r).Jitter },
+	"hops":   func(r *Report, _ int) float64 { return float64(r.Hops) },
+	// VoIP quality estimate, see voip.go
+	"mos":      func(r *Report, _ int) float64 { return reportVoIP(r).MOS },
+	"r-factor": func(r *Report, _ int) float64 { return reportVoIP(r).RFactor },
+	// hops added or removed since the previous report
+	"hop-change": func(r *Report, prevHops int) float64 {
+		if prevHops == 0 {
+			return 0
+		}
+		diff := float64(r.Hops - prevHops)
+		if diff < 0 {
+			return -diff
+		}
+		return diff
+	},
+}
+
+// The target hop. When the last hop isn't the target, it didn't reply to
+// any probe.
+func lastHop(r *Report) *Host {
+	if len(r.Hosts) == 0 {
+		// nothing replied
+		return &Host{LostPercent: 100}
+	}
+	last := r.Hosts[len(r.Hosts)-1]
+	if len(r.targets) == 0 || last.IP == unknownHop {
+		// couldn't resolve it, or already the unknown target
+		return last
+	}
+	for _, target := range r.targets {
+		if last.IP == target {
+			return last
+		}
+	}
+	return &Host{IP: unknownHop, Hop: last.Hop + 1, Sent: last.Sent, LostPercent: 100}
+}
+
+func (c *AlertsConfig) validate() error {
+	if c.Topic == "" {
+		c.Topic = defaultAlertTopic
+	}
+
+	for _, rule := range c.Rules {
+		if _, ok := alertMetrics[rule.Metric]; !ok {
+			return fmt.Errorf("Unknown metric '%s' in alert rule '%s'", rule.Metric, rule.Name)
+		}
+		switch rule.Operator {
+		case "":
+			rule.Operator = ">"
+		case ">", "<":
+		default:
+			return fmt.Errorf("Invalid operator '%s' in alert rule '%s'", rule.Operator, rule.Name)
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s %s %g", rule.Metric, rule.Operator, rule.Threshold)
+		}
+		if rule.Clear == nil {
+			rule.Clear = &rule.Threshold
+		}
+		if rule.Consecutive < 1 {
+			rule.Consecutive = 1
+		}
+	}
+
+	return nil
+}
+
+func (rule *AlertRule) breached(value float64) bool {
+	if rule.Operator == "<" {
+		return value < rule.Threshold
+	}
+	return value > rule.Threshold
+}
+
+func (rule *AlertRule) cleared(value float64) bool {
+	if rule.Operator == "<" {
+		return value >= *rule.Clear
+	}
+	return value <= *rule.Clear
+}
+
+type alertState struct {
+	firing bool
+	// consecutive reports breaching (or clearing, when firing) the rule
+	count int
+}
+
+type alertEvaluator struct {
+	rules []*AlertRule
+
+	mu sync.Mutex
+	// by rule name and target
+	states map[string]*alertState
+	// hops in the previous report of every target
+	hops map[string]int
+}
+
+func newAlertEvaluator(rules []*AlertRule) *alertEvaluator {
+	return &alertEvaluator{
+		rules:  rules,
+		states: map[string]*alertState{},
+		hops:   map[string]int{},
+	}
+}
+
+// Evaluate all the rules against the report, returning the alerts that
+// started firing or got resolved.
+func (e *alertEvaluator) evaluate(r *Report) []*Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	alerts := []*Alert{}
+	prevHops := e.hops[r.Target]
+	e.hops[r.Target] = r.Hops
+
+	for _, rule := range e.rules {
+		if rule.Target != "" && rule.Target != r.Target {
+			continue
+		}
+
+		key := rule.Name + "\x00" + r.Target
+		state := e.states[key]
+		if state == nil {
+			state = &alertState{}
+			e.states[key] = state
+		}
+
+		value := alertMetrics[rule.Metric](r, prevHops)
+		if (!state.firing && rule.breached(value)) || (state.firing && rule.cleared(value)) {
+			state.count++
+		} else {
+			state.count = 0
+		}
+
+		if state.count < rule.Consecutive {
+			continue
+		}
+
+		state.firing = !state.firing
+		state.count = 0
+		alert := &Alert{
+			Rule:      rule.Name,
+			Target:    r.Target,
+			State:     "firing",
+			Metric:    rule.Metric,
+			Value:     value,
+			Threshold: rule.Threshold,
+			Time:      r.Time,
+			Location:  r.Location,
+		}
+		if !state.firing {
+			alert.State = "resolved"
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts
+}
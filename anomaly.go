@@ -0,0 +1,184 @@
+package main
+
+// Adaptive baselines and anomaly detection.
+//
+// Every target gets an exponentially weighted moving average (and
+// variance) of the end-to-end RTT and loss, updated with every report.
+// Values deviating more than threshold standard deviations from the
+// baseline are sent as anomaly events, the deviation being the score.
+// Baselines are saved to state_file so they survive restarts.
+//
+//   "anomalies": {
+//     "enabled": true,
+//     "state_file": "/var/lib/push-mtr/baselines.json",
+//     "alpha": 0.1,
+//     "threshold": 3,
+//     "warmup": 10
+//   }
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultAnomalyTopic = "/events/anomaly"
+
+// Deviations smaller than this aren't significant even if the baseline
+// barely changed so far (a target with no loss at all, etc).
+var anomalyMinStdDev = map[string]float64{
+	"rtt":  1,
+	"loss": 2,
+}
+
+type AnomalyConfig struct {
+	Enabled   bool    `json:"enabled"`
+	Topic     string  `json:"topic"`
+	StateFile string  `json:"state_file"`
+	Alpha     float64 `json:"alpha"`
+	Threshold float64 `json:"threshold"`
+	// reports needed before the baseline is trusted
+	Warmup int `json:"warmup"`
+}
+
+type Anomaly struct {
+	Target   string          `json:"target"`
+	Metric   string          `json:"metric"`
+	Value    float64         `json:"value"`
+	Baseline float64         `json:"baseline"`
+	StdDev   float64         `json:"standard-dev"`
+	Score    float64         `json:"score"`
+	Time     time.Time       `json:"time"`
+	Location *ReportLocation `json:"location"`
+}
+
+type baseline struct {
+	Mean     float64 `json:"mean"`
+	Variance float64 `json:"variance"`
+	Samples  int     `json:"samples"`
+}
+
+func (c *AnomalyConfig) validate() error {
+	if c.Topic == "" {
+		c.Topic = defaultAnomalyTopic
+	}
+	if c.Alpha <= 0 || c.Alpha > 1 {
+		c.Alpha = 0.1
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = 3
+	}
+	if c.Warmup <= 0 {
+		c.Warmup = 10
+	}
+
+	return nil
+}
+
+type anomalyDetector struct {
+	config *AnomalyConfig
+
+	mu sync.Mutex
+	// by target and metric
+	baselines map[string]map[string]*baseline
+}
+
+func newAnomalyDetector(config *AnomalyConfig) *anomalyDetector {
+	d := &anomalyDetector{
+		config:    config,
+		baselines: map[string]map[string]*baseline{},
+	}
+
+	if config.StateFile == "" {
+		return d
+	}
+
+	data, err := ioutil.ReadFile(config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Error reading baselines, starting from scratch: %s", err)
+		}
+		return d
+	}
+	if err := json.Unmarshal(data, &d.baselines); err != nil {
+		log.Warnf("Error parsing baselines, starting from scratch: %s", err)
+	}
+
+	return d
+}
+
+// Update the baselines of the report target, returning the metrics that
+// deviated from them.
+func (d *anomalyDetector) evaluate(r *Report) []*Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	anomalies := []*Anomaly{}
+	dest := lastHop(r)
+	values := map[string]float64{"loss": dest.LostPercent}
+	if dest.LostPercent < 100 {
+		values["rtt"] = dest.Avg
+	}
+
+	if d.baselines[r.Target] == nil {
+		d.baselines[r.Target] = map[string]*baseline{}
+	}
+	for metric, value := range values {
+		b := d.baselines[r.Target][metric]
+		if b == nil {
+			b = &baseline{Mean: value}
+			d.baselines[r.Target][metric] = b
+		}
+
+		stdDev := math.Max(math.Sqrt(b.Variance), anomalyMinStdDev[metric])
+		score := (value - b.Mean) / stdDev
+		if b.Samples >= d.config.Warmup && math.Abs(score) > d.config.Threshold {
+			anomalies = append(anomalies, &Anomaly{
+				Target:   r.Target,
+				Metric:   metric,
+				Value:    value,
+				Baseline: b.Mean,
+				StdDev:   stdDev,
+				Score:    score,
+				Time:     r.Time,
+				Location: r.Location,
+			})
+		}
+
+		diff := value - b.Mean
+		incr := d.config.Alpha * diff
+		b.Mean += incr
+		b.Variance = (1 - d.config.Alpha) * (b.Variance + diff*incr)
+		b.Samples++
+	}
+
+	d.save()
+
+	return anomalies
+}
+
+func (d *anomalyDetector) save() {
+	if d.config.StateFile == "" {
+		return
+	}
+
+	data, err := json.Marshal(d.baselines)
+	if err != nil {
+		log.Warnf("Error marshaling baselines: %s", err)
+		return
+	}
+
+	// write and rename so a crash never leaves a truncated file behind
+	tmp := d.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Warnf("Error saving baselines: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, d.config.StateFile); err != nil {
+		log.Warnf("Error saving baselines: %s", err)
+	}
+}
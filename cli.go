@@ -0,0 +1,189 @@
+package main
+
+// Output of the commands meant to be run by hand: push-mtr run prints the
+// report as a table, like mtr --report does, and push-mtr check-broker
+// tells which step of the connection to every broker fails.
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const brokerCheckTimeout = 10 * time.Second
+
+// Width of the host column, fitting the longest IP
+func hostWidth(hosts []*Host) int {
+	width := len(unknownHop)
+	for _, h := range hosts {
+		if len(h.IP) > width {
+			width = len(h.IP)
+		}
+	}
+	return width
+}
+
+func printHostRows(w io.Writer, hosts []*Host, width int) {
+	for _, h := range hosts {
+		fmt.Fprintf(w, "%3d.|-- %-*s %5.1f%% %5d %6.1f %6.1f %6.1f %6.1f %6.1f %6.1f\n",
+			h.Hop, width, h.IP, h.LostPercent, h.Sent, h.Last, h.Avg, h.Best, h.Worst, h.StDev, h.Jitter)
+	}
+}
+
+func printReportTable(w io.Writer, r *Report) {
+	// every path with multipath, they may have different hosts
+	paths := r.Paths
+	if len(paths) == 0 {
+		paths = []*Path{{Hosts: r.Hosts}}
+	}
+	width := 0
+	for _, p := range paths {
+		if hw := hostWidth(p.Hosts); hw > width {
+			width = hw
+		}
+	}
+
+	fmt.Fprintf(w, "%-*s %6s %5s %6s %6s %6s %6s %6s %6s\n", width+8, "HOST: "+r.Target,
+		"Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev", "Jitter")
+	for _, p := range paths {
+		if len(paths) > 1 {
+			flows := make([]string, len(p.Flows))
+			for i, f := range p.Flows {
+				flows[i] = fmt.Sprint(f)
+			}
+			fmt.Fprintf(w, "Path %d, flows %s:\n", p.ID, strings.Join(flows, ", "))
+		}
+		printHostRows(w, p.Hosts, width)
+	}
+
+	if v := r.VoIP; v != nil {
+		fmt.Fprintf(w, "\nVoIP %s: MOS %.2f, R-factor %.1f, %.1f ms one way\n", v.Codec, v.MOS, v.RFactor, v.Delay)
+	}
+	if m := r.PathMTU; m != nil {
+		switch {
+		case m.Error != "":
+			fmt.Fprintf(w, "Path MTU: %s\n", m.Error)
+		case m.BlackHole:
+			fmt.Fprintf(w, "Path MTU: %d bytes, black hole beyond\n", m.MTU)
+		default:
+			fmt.Fprintf(w, "Path MTU: %d bytes\n", m.MTU)
+		}
+		for _, f := range m.FragNeeded {
+			fmt.Fprintf(w, "  fragmentation needed from %s (hop %d), next hop MTU %d\n", f.IP, f.Hop, f.NextHopMTU)
+		}
+	}
+	if r.Incomplete {
+		fmt.Fprintf(w, "Incomplete, interrupted after %s\n", r.ElapsedTime.Round(time.Millisecond))
+	}
+}
+
+func printPingTable(w io.Writer, r *PingResult) {
+	target := r.Target
+	if r.IP != "" && r.IP != r.Target {
+		target = fmt.Sprintf("%s (%s)", r.Target, r.IP)
+	}
+
+	fmt.Fprintf(w, "%-*s %6s %5s %5s %6s %6s %6s %6s %6s\n", len(target)+6, "PING: "+target,
+		"Loss%", "Snt", "Rcv", "Min", "Avg", "Max", "StDev", "Jitter")
+	fmt.Fprintf(w, "%-*s %5.1f%% %5d %5d %6.1f %6.1f %6.1f %6.1f %6.1f\n", len(target)+6, "",
+		r.Loss, r.Sent, r.Received, r.Min, r.Avg, r.Max, r.StDev, r.Jitter)
+
+	if r.Error != "" {
+		fmt.Fprintf(w, "Error: %s\n", r.Error)
+	}
+	if r.Incomplete {
+		fmt.Fprintln(w, "Incomplete, interrupted")
+	}
+}
+
+// Check every broker on its own, printing how far we got. False if any
+// failed.
+func checkBrokers(brokerUrls []string, clientID string, tlsConfig *tls.Config) bool {
+	ok := true
+	for _, broker := range brokerUrls {
+		name := broker
+		if uri, err := url.Parse(broker); err == nil {
+			name = uri.Redacted()
+		}
+		fmt.Println(name)
+
+		if err := checkBroker(broker, clientID, tlsConfig); err != nil {
+			fmt.Printf("  FAILED %s\n", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func checkBroker(broker, clientID string, tlsConfig *tls.Config) error {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %s", err)
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", uri.Host, brokerCheckTimeout)
+	if err != nil {
+		return fmt.Errorf("connecting: %s", err)
+	}
+	conn.Close()
+	fmt.Printf("  connection OK (%s)\n", time.Since(start).Round(time.Millisecond))
+
+	if uri.Scheme == "ssl" {
+		start = time.Now()
+		dialer := &net.Dialer{Timeout: brokerCheckTimeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", uri.Host, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("TLS handshake: %s", err)
+		}
+		state := conn.ConnectionState()
+		conn.Close()
+		info := newTLSInfo(&state)
+		verified := "verified"
+		if tlsConfig.InsecureSkipVerify {
+			verified = "not verified, --insecure"
+		}
+		fmt.Printf("  TLS OK (%s, %s, certificate of %s %s, expires in %d days)\n",
+			info.Version, info.CipherSuite, info.Subject, verified, info.DaysToExpiry)
+	}
+
+	// our own client ID, not to kick a running agent out of the broker
+	clientID += "-check"
+	start = time.Now()
+	opts := mqttClientOptions([]string{broker}, &clientID, tlsConfig)
+	// the default handler exits, refused connections included
+	opts.SetOnConnectionLost(func(*mqtt.MqttClient, error) {})
+	client := mqtt.NewClient(opts)
+	connected := make(chan error, 1)
+	go func() {
+		_, err := client.Start()
+		connected <- err
+	}()
+	select {
+	case err := <-connected:
+		if err != nil && uri.User != nil {
+			return fmt.Errorf("MQTT connect, wrong credentials? %s", err)
+		}
+		if err != nil {
+			return fmt.Errorf("MQTT connect: %s", err)
+		}
+	case <-time.After(brokerCheckTimeout):
+		return errors.New("MQTT connect: no reply from the broker")
+	}
+	elapsed := time.Since(start)
+	client.Disconnect(250)
+
+	auth := "anonymous"
+	if uri.User != nil {
+		auth = "as " + uri.User.Username()
+	}
+	fmt.Printf("  MQTT connect OK, %s (%s)\n", auth, elapsed.Round(time.Millisecond))
+
+	return nil
+}
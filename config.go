@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Agent settings not worth a command line flag, read from the JSON
+// file given with --config
+type Config struct {
+	Alerts    AlertsConfig  `json:"alerts"`
+	Anomalies AnomalyConfig `json:"anomalies"`
+	// codec for the VoIP quality estimate, see voip.go
+	VoIP      Codec       `json:"voip"`
+	URLChecks []*URLCheck `json:"url_checks"`
+	// see throughput.go
+	ThroughputTests []*ThroughputTest `json:"throughput_tests"`
+	// see dns.go
+	DNSTests []*DNSTest `json:"dns_tests"`
+	// see tcpconnect.go
+	TCPTests []*TCPTest `json:"tcp_tests"`
+	// see ping.go
+	PingTests []*PingTest `json:"ping_tests"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config file: %s", err)
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("Error parsing config file %s: %s", path, err)
+		}
+	}
+
+	// fill in the defaults
+	if err := config.Alerts.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Anomalies.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.VoIP.validate(); err != nil {
+		return nil, err
+	}
+	for _, check := range config.URLChecks {
+		if err := check.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range config.ThroughputTests {
+		if err := test.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range config.DNSTests {
+		if err := test.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range config.TCPTests {
+		if err := test.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, test := range config.PingTests {
+		if err := test.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+// DNS resolution tests, timing how long resolvers take to answer.
+//
+//   "dns_tests": [
+//     {"names": ["example.com", "mail.example.com"], "type": "A", "interval": 60,
+//      "resolvers": ["system", "8.8.8.8", "tcp://1.1.1.1", "tls://1.1.1.1", "https://cloudflare-dns.com/dns-query"]}
+//   ]
+//
+// Resolvers are "system" (the nameservers in /etc/resolv.conf, tried in
+// order until one answers), IP[:port] queried over UDP, or tcp://, tls://
+// (DNS over TLS) and https:// (DNS over HTTPS) URLs. Every name is queried
+// against every resolver, each result being sent on its own.
+//
+// type defaults to A, resolvers to system, timeout to 5 seconds per
+// query, the schedule (see schedule.go) and topic to --repeat/--cron and
+// --dns-topic.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+type DNSTest struct {
+	Names     []string `json:"names"`
+	Type      string   `json:"type"`
+	Resolvers []string `json:"resolvers"`
+	Topic     string   `json:"topic"`
+	Schedule
+	// seconds
+	Timeout int `json:"timeout"`
+}
+
+type DNSResult struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// as configured, and the server that answered it
+	Resolver string    `json:"resolver"`
+	Server   string    `json:"server"`
+	Protocol string    `json:"protocol"`
+	Time     time.Time `json:"time"`
+	// milliseconds, connection setup included for TCP, TLS and HTTPS
+	ResponseTime float64         `json:"response_time"`
+	Rcode        string          `json:"rcode"`
+	Truncated    bool            `json:"truncated"`
+	Answers      []*DNSAnswer    `json:"answers"`
+	Error        string          `json:"error,omitempty"`
+	Incomplete   bool            `json:"incomplete,omitempty"`
+	Location     *ReportLocation `json:"location"`
+	Egress       *Egress         `json:"egress,omitempty"`
+}
+
+// Where to send the queries: host:port, or the URL for DNS over HTTPS
+type dnsServer struct {
+	protocol string
+	address  string
+}
+
+func (t *DNSTest) validate() error {
+	if len(t.Names) == 0 {
+		return errors.New("DNS test without names")
+	}
+	t.Type = strings.ToUpper(t.Type)
+	if t.Type == "" {
+		t.Type = "A"
+	}
+	if _, ok := dnsTypes[t.Type]; !ok {
+		return fmt.Errorf("Unsupported type '%s' in DNS test", t.Type)
+	}
+	if len(t.Resolvers) == 0 {
+		t.Resolvers = []string{"system"}
+	}
+	for _, resolver := range t.Resolvers {
+		if _, err := parseResolver(resolver); err != nil {
+			return err
+		}
+	}
+	if err := t.Schedule.validate(); err != nil {
+		return fmt.Errorf("Invalid DNS test of %s: %s", strings.Join(t.Names, ", "), err)
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = 5
+	}
+
+	return nil
+}
+
+// The nameservers in resolv.conf, localhost when there are none
+func systemNameservers() []dnsServer {
+	servers := []dnsServer{}
+
+	f, err := os.Open(resolvConf)
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				servers = append(servers, dnsServer{"udp", net.JoinHostPort(ip.String(), "53")})
+			}
+		}
+	}
+
+	if len(servers) == 0 {
+		servers = append(servers, dnsServer{"udp", "127.0.0.1:53"})
+	}
+	return servers
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func parseResolver(resolver string) ([]dnsServer, error) {
+	if resolver == "system" {
+		return systemNameservers(), nil
+	}
+
+	if !strings.Contains(resolver, "://") {
+		address := withDefaultPort(resolver, "53")
+		host, _, _ := net.SplitHostPort(address)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid resolver %s: not an IP address", resolver)
+		}
+		return []dnsServer{{"udp", address}}, nil
+	}
+
+	u, err := url.Parse(resolver)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid resolver %s: %s", resolver, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		return []dnsServer{{"tcp", withDefaultPort(u.Host, "53")}}, nil
+	case "tls":
+		return []dnsServer{{"tls", withDefaultPort(u.Host, "853")}}, nil
+	case "https":
+		return []dnsServer{{"https", resolver}}, nil
+	}
+	return nil, fmt.Errorf("Invalid resolver %s: udp, tcp, tls and https supported", resolver)
+}
+
+func dnsExchangeUDP(ctx context.Context, address string, query []byte) ([]byte, error) {
+	conn, err := egress.dialer("udp").DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray answers to previous queries
+		if n >= 2 && binary.BigEndian.Uint16(buf) == binary.BigEndian.Uint16(query) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// DNS over TCP and TLS, messages prefixed with their length
+func dnsExchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, msg[:2]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(msg))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DNS over HTTPS (RFC 8484), through --proxy if set
+func dnsExchangeHTTPS(ctx context.Context, address string, query []byte) ([]byte, error) {
+	transport, err := egress.transport(egress.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", address, strings.NewReader(string(query)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func dnsExchange(ctx context.Context, server dnsServer, query []byte) ([]byte, error) {
+	switch server.protocol {
+	case "tcp":
+		conn, err := egress.dialer("tcp").DialContext(ctx, "tcp", server.address)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return dnsExchangeStream(ctx, conn, query)
+	case "tls":
+		host, _, _ := net.SplitHostPort(server.address)
+		dialer := &tls.Dialer{
+			NetDialer: egress.dialer("tcp"),
+			Config:    &tls.Config{ServerName: host},
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", server.address)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return dnsExchangeStream(ctx, conn, query)
+	case "https":
+		return dnsExchangeHTTPS(ctx, server.address, query)
+	}
+	return dnsExchangeUDP(ctx, server.address, query)
+}
+
+// Query name against resolver, trying its servers in order until one
+// answers or ctx is done
+func dnsQuery(ctx context.Context, name, qtype, resolver string, timeout time.Duration) *DNSResult {
+	res := &DNSResult{
+		Name:     name,
+		Type:     qtype,
+		Resolver: resolver,
+		Time:     time.Now(),
+		Answers:  []*DNSAnswer{},
+		Egress:   egress.report(""),
+	}
+
+	servers, err := parseResolver(resolver)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	for _, server := range servers {
+		res.Server = server.address
+		res.Protocol = server.protocol
+
+		id := uint16(rand.Intn(1 << 16))
+		query, err := buildDNSQuery(id, name, dnsTypes[qtype])
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+
+		qctx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		msg, err := dnsExchange(qctx, server, query)
+		res.ResponseTime = float64(time.Since(start)) / float64(time.Millisecond)
+		cancel()
+		if err != nil {
+			res.Error = err.Error()
+			if ctx.Err() != nil {
+				// no time left for the other servers
+				res.Incomplete = true
+				break
+			}
+			continue
+		}
+
+		resp, err := parseDNSResponse(msg)
+		if err == nil && resp.id != id {
+			err = errors.New("DNS response ID mismatch")
+		}
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+
+		res.Error = ""
+		res.Rcode = resp.rcode
+		res.Truncated = resp.truncated
+		if resp.answers != nil {
+			res.Answers = resp.answers
+		}
+		break
+	}
+
+	return res
+}
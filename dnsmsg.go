@@ -0,0 +1,228 @@
+package main
+
+// Just enough of the DNS wire format (RFC 1035) to send a query and read
+// the answers.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var dnsTypes = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+}
+
+var dnsRcodes = map[int]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+var errDNSShort = errors.New("DNS message too short")
+
+type DNSAnswer struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+type dnsResponse struct {
+	id        uint16
+	rcode     string
+	truncated bool
+	answers   []*DNSAnswer
+}
+
+func dnsTypeName(t uint16) string {
+	for name, value := range dnsTypes {
+		if value == t {
+			return name
+		}
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// Recursive query for name
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// recursion desired
+	msg[2] = 0x01
+	// one question
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("Invalid DNS name %s", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+
+	// class IN
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg, nil
+}
+
+// Read the possibly compressed name at off, returning it and the offset
+// right after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	// compression pointers could loop forever
+	for jumps := 0; jumps < 64; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errDNSShort
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+
+	return "", 0, errors.New("DNS name compression loop")
+}
+
+func parseDNSResponse(msg []byte) (*dnsResponse, error) {
+	if len(msg) < 12 {
+		return nil, errDNSShort
+	}
+	resp := &dnsResponse{
+		id:        binary.BigEndian.Uint16(msg[0:]),
+		truncated: msg[2]&0x02 != 0,
+	}
+	rcode := int(msg[3] & 0x0f)
+	resp.rcode = dnsRcodes[rcode]
+	if resp.rcode == "" {
+		resp.rcode = fmt.Sprintf("RCODE%d", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		// type and class
+		off = next + 4
+	}
+
+	for i := 0; i < ancount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errDNSShort
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, errDNSShort
+		}
+
+		data, err := dnsRecordData(msg, off, rtype, msg[off:off+rdlength])
+		if err != nil {
+			return nil, err
+		}
+		resp.answers = append(resp.answers, &DNSAnswer{
+			Name: name,
+			Type: dnsTypeName(rtype),
+			TTL:  ttl,
+			Data: data,
+		})
+		off += rdlength
+	}
+
+	return resp, nil
+}
+
+// Presentation format of the record data, rdata being at off in msg
+func dnsRecordData(msg []byte, off int, rtype uint16, rdata []byte) (string, error) {
+	switch dnsTypeName(rtype) {
+	case "A", "AAAA":
+		return net.IP(rdata).String(), nil
+	case "NS", "CNAME", "PTR":
+		name, _, err := readDNSName(msg, off)
+		return name, err
+	case "MX":
+		if len(rdata) < 3 {
+			return "", errDNSShort
+		}
+		name, _, err := readDNSName(msg, off+2)
+		return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rdata), name), err
+	case "SRV":
+		if len(rdata) < 7 {
+			return "", errDNSShort
+		}
+		name, _, err := readDNSName(msg, off+6)
+		return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(rdata), binary.BigEndian.Uint16(rdata[2:]),
+			binary.BigEndian.Uint16(rdata[4:]), name), err
+	case "TXT":
+		strs := []string{}
+		for i := 0; i < len(rdata); {
+			length := int(rdata[i])
+			if i+1+length > len(rdata) {
+				return "", errDNSShort
+			}
+			strs = append(strs, fmt.Sprintf("%q", rdata[i+1:i+1+length]))
+			i += 1 + length
+		}
+		return strings.Join(strs, " "), nil
+	case "SOA":
+		mname, next, err := readDNSName(msg, off)
+		if err != nil {
+			return "", err
+		}
+		rname, next, err := readDNSName(msg, next)
+		if err != nil {
+			return "", err
+		}
+		if next+20 > len(msg) {
+			return "", errDNSShort
+		}
+		return fmt.Sprintf("%s %s %d", mname, rname, binary.BigEndian.Uint32(msg[next:])), nil
+	}
+
+	return fmt.Sprintf("%x", rdata), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Message from its hex dump, spaces ignored
+func dnsHex(t *testing.T, s string) []byte {
+	msg, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		id        uint16
+		rcode     string
+		truncated bool
+		answers   []*DNSAnswer
+	}{
+		{
+			name:  "A",
+			msg:   "12348180000100010000000007657861 6d706c6503636f6d0000010001c00c00 01000100000e1000045db8d822",
+			id:    0x1234,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "example.com.", Type: "A", TTL: 3600, Data: "93.184.216.34"},
+			},
+		},
+		{
+			name:  "AAAA",
+			msg:   "12348180000100010000000007657861 6d706c6503636f6d00001c0001c00c00 1c00010000012c001026062800022000 01024818931c891946",
+			id:    0x1234,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "example.com.", Type: "AAAA", TTL: 300, Data: "2606:2800:220:1:248:1893:1c89:1946"},
+			},
+		},
+		{
+			name:  "CNAME pointing inside the question",
+			msg:   "00018180000100020000000003777777 076578616d706c6503636f6d00000100 01c00c000500010000003c0002c010c0 10000100010000003c0004c0000201",
+			id:    1,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "www.example.com.", Type: "CNAME", TTL: 60, Data: "example.com."},
+				{Name: "example.com.", Type: "A", TTL: 60, Data: "192.0.2.1"},
+			},
+		},
+		{
+			name:  "MX",
+			msg:   "00028180000100010000000007657861 6d706c6503636f6d00000f0001c00c00 0f000100000e100009000a046d61696c c00c",
+			id:    2,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "example.com.", Type: "MX", TTL: 3600, Data: "10 mail.example.com."},
+			},
+		},
+		{
+			name:  "SRV",
+			msg:   "000381800001000100000000045f7369 70045f746370076578616d706c650363 6f6d0000210001c00c00210001000151 80000c000a003c13c403736970c016",
+			id:    3,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "_sip._tcp.example.com.", Type: "SRV", TTL: 86400, Data: "10 60 5060 sip.example.com."},
+			},
+		},
+		{
+			name:  "TXT",
+			msg:   "00048180000100010000000007657861 6d706c6503636f6d0000100001c00c00 1000010000012c00120b763d73706631 202d616c6c0568656c6c6f",
+			id:    4,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "example.com.", Type: "TXT", TTL: 300, Data: `"v=spf1 -all" "hello"`},
+			},
+		},
+		{
+			name:  "SOA",
+			msg:   "00058180000100010000000007657861 6d706c6503636f6d0000060001c00c00 06000100000e100027036e7331c00c0a 686f73746d6173746572c00c78a3f175 00001c2000000e10001275000000012c",
+			id:    5,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "example.com.", Type: "SOA", TTL: 3600, Data: "ns1.example.com. hostmaster.example.com. 2024010101"},
+			},
+		},
+		{
+			name:  "unknown type",
+			msg:   "00088180000100010000000007657861 6d706c6503636f6d0000630001c00c00 6300010000003c0002dead",
+			id:    8,
+			rcode: "NOERROR",
+			answers: []*DNSAnswer{
+				{Name: "example.com.", Type: "TYPE99", TTL: 60, Data: "dead"},
+			},
+		},
+		{
+			name:  "NXDOMAIN",
+			msg:   "000681830001000000000000076e6f77 68657265076578616d706c6503636f6d 0000010001",
+			id:    6,
+			rcode: "NXDOMAIN",
+		},
+		{
+			name:      "truncated flag",
+			msg:       "00078380000100000000000007657861 6d706c6503636f6d0000100001",
+			id:        7,
+			rcode:     "NOERROR",
+			truncated: true,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := parseDNSResponse(dnsHex(t, test.msg))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if resp.id != test.id || resp.rcode != test.rcode || resp.truncated != test.truncated {
+			t.Errorf("%s: id %d rcode %s truncated %v, expected %d %s %v", test.name,
+				resp.id, resp.rcode, resp.truncated, test.id, test.rcode, test.truncated)
+		}
+		if !reflect.DeepEqual(resp.answers, test.answers) {
+			t.Errorf("%s: answers", test.name)
+			for _, a := range resp.answers {
+				t.Logf("  %+v", *a)
+			}
+		}
+	}
+}
+
+func TestParseDNSResponseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		err  string
+	}{
+		{"header cut", "1234818000010001", errDNSShort.Error()},
+		{"question cut", "12348180000100010000000007657861 6d70", errDNSShort.Error()},
+		{"answer cut", "12348180000100010000000007657861 6d706c6503636f6d0000010001c00c00 0100", errDNSShort.Error()},
+		{"rdata cut", "12348180000100010000000007657861 6d706c6503636f6d0000010001c00c00 01000100000e1000045db8", errDNSShort.Error()},
+		{"pointer cut", "12348180000100010000000007657861 6d706c6503636f6d0000010001c0", errDNSShort.Error()},
+		{"pointer past the end", "000a8180000100010000000007657861 6d706c6503636f6d0000010001c0c800 0100010000003c000400000000", errDNSShort.Error()},
+		{"pointer to itself", "00098180000100010000000007657861 6d706c6503636f6d0000010001c01d00 0100010000003c000400000000", "DNS name compression loop"},
+		{"pointers to each other", "00098180000100010000000007657861 6d706c6503636f6d0000010001c01fc0 1d00010000003c000400000000", "DNS name compression loop"},
+		{"MX rdata cut", "00028180000100010000000007657861 6d706c6503636f6d00000f0001c00c00 0f000100000e10000100", errDNSShort.Error()},
+		{"TXT string cut", "00048180000100010000000007657861 6d706c6503636f6d0000100001c00c00 1000010000012c00020b76", errDNSShort.Error()},
+	}
+
+	for _, test := range tests {
+		_, err := parseDNSResponse(dnsHex(t, test.msg))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: error %v, expected %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestBuildDNSQuery(t *testing.T) {
+	msg, err := buildDNSQuery(0xbeef, "www.example.com.", dnsTypes["AAAA"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "beef0100000100000000000003777777 076578616d706c6503636f6d00001c0001"
+	if got := hex.EncodeToString(msg); got != strings.ReplaceAll(want, " ", "") {
+		t.Errorf("query %s", got)
+	}
+
+	for _, name := range []string{"", "a..example.com", strings.Repeat("a", 64) + ".com"} {
+		if _, err := buildDNSQuery(1, name, dnsTypes["A"]); err == nil {
+			t.Errorf("%q: invalid name accepted", name)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+// Source address, interface and proxy the probes egress through.
+//
+// mtr gets -a and -I, native probes bind their sockets and URL tests dial
+// through the proxy, if any.
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+type Egress struct {
+	SourceAddress string `json:"source_address,omitempty"`
+	Interface     string `json:"interface,omitempty"`
+	Proxy         string `json:"proxy,omitempty"`
+}
+
+// set from the command line flags
+var egress = &Egress{}
+
+func (e *Egress) validate() error {
+	if e.SourceAddress != "" && net.ParseIP(e.SourceAddress) == nil {
+		return fmt.Errorf("Invalid source address %s", e.SourceAddress)
+	}
+	if e.Interface != "" {
+		if _, err := net.InterfaceByName(e.Interface); err != nil {
+			return fmt.Errorf("Invalid interface %s: %s", e.Interface, err)
+		}
+	}
+	if e.Proxy != "" {
+		if _, err := parseProxy(e.Proxy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// What to record in the reports, nil when using the defaults
+func (e *Egress) report(proxyURL string) *Egress {
+	r := &Egress{
+		SourceAddress: e.SourceAddress,
+		Interface:     e.Interface,
+	}
+	if u, err := url.Parse(proxyURL); err == nil && proxyURL != "" {
+		// no credentials in the reports
+		r.Proxy = u.Redacted()
+	}
+
+	if *r == (Egress{}) {
+		return nil
+	}
+	return r
+}
+
+func (e *Egress) mtrArgs() []string {
+	args := []string{}
+	if e.SourceAddress != "" {
+		args = append(args, "-a", e.SourceAddress)
+	}
+	if e.Interface != "" {
+		args = append(args, "-I", e.Interface)
+	}
+	return args
+}
+
+// Bind the sockets created by dialers and listeners to the interface
+func (e *Egress) control(network, address string, c syscall.RawConn) error {
+	if e.Interface == "" {
+		return nil
+	}
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = bindToDevice(fd, e.Interface)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Dialer for network, tcp or udp
+func (e *Egress) dialer(network string) *net.Dialer {
+	d := &net.Dialer{Control: e.control}
+	if e.SourceAddress == "" {
+		return d
+	}
+	// net.Dialer ignores local addresses not matching the network
+	ip := net.ParseIP(e.SourceAddress)
+	if strings.HasPrefix(network, "udp") {
+		d.LocalAddr = &net.UDPAddr{IP: ip}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d
+}
+
+// Listen on network (udp4, ip4:icmp, ...) bound to the source address and
+// interface.
+func (e *Egress) listenPacket(network string) (net.PacketConn, error) {
+	lc := &net.ListenConfig{Control: e.control}
+	address := "0.0.0.0"
+	if e.SourceAddress != "" {
+		address = e.SourceAddress
+	}
+	if network == "udp4" || network == "udp6" {
+		address = net.JoinHostPort(address, "0")
+	}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+func parseProxy(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy %s: %s", proxyURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("Invalid proxy %s: http, https and socks5 supported", proxyURL)
+}
+
+// First IPv4 address of host, ctx bounding the lookup
+func resolveIP4(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// net.ResolveTCPAddr, IPv4 preferred, ctx bounding the lookups
+func resolveTCP(ctx context.Context, host, port string) (*net.TCPAddr, error) {
+	p, err := net.DefaultResolver.LookupPort(ctx, "tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.TCPAddr{IP: ips[0].IP, Port: p, Zone: ips[0].Zone}
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			addr.IP, addr.Zone = ip.IP, ""
+			break
+		}
+	}
+	return addr, nil
+}
+
+// Run dial, giving up when ctx is done first, for dialers not taking a
+// context. The connection is closed if it comes later.
+func dialContext(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		conn, err := dial()
+		done <- dialed{conn, err}
+	}()
+
+	select {
+	case d := <-done:
+		return d.conn, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-done; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// HTTP transport egressing through the source address and interface, and
+// proxyURL unless empty.
+func (e *Egress) transport(proxyURL string) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	d := e.dialer("tcp")
+	t.DialContext = d.DialContext
+	t.Proxy = nil
+
+	if proxyURL == "" {
+		return t, nil
+	}
+	u, err := parseProxy(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "socks5" {
+		t.Proxy = http.ProxyURL(u)
+		return t, nil
+	}
+
+	socks, err := proxy.FromURL(u, d)
+	if err != nil {
+		return nil, err
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialContext(ctx, func() (net.Conn, error) { return socks.Dial(network, addr) })
+	}
+	return t, nil
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
 	"os"
 	"os/exec"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -22,14 +25,35 @@ type Host struct {
 	Best        float64 `json:"best"`
 	Worst       float64 `json:"worst"`
 	StDev       float64 `json:"standard-dev"`
+	P50         float64 `json:"p50"`
+	P90         float64 `json:"p90"`
+	P95         float64 `json:"p95"`
+	P99         float64 `json:"p99"`
+	// mean absolute difference between consecutive RTTs
+	Jitter float64 `json:"jitter"`
+	// RTT of every probe sent, nil if it timed out
+	Samples []*float64 `json:"samples,omitempty"`
 }
 
 type Report struct {
 	Time        time.Time       `json:"time"`
+	Target      string          `json:"target"`
 	Hosts       []*Host         `json:"hosts"`
 	Hops        int             `json:"hops"`
 	ElapsedTime time.Duration   `json:"elapsed_time"`
+	Incomplete  bool            `json:"incomplete,omitempty"`
 	Location    *ReportLocation `json:"location"`
+	Egress      *Egress         `json:"egress,omitempty"`
+	Probe       *ProbeOptions   `json:"probe"`
+	// call quality estimate for the last hop, see voip.go
+	VoIP *VoIPScore `json:"voip"`
+	// with --path-mtu, see pmtu.go
+	PathMTU *PathMTU `json:"path_mtu,omitempty"`
+	// multipath mode only, see multipath.go
+	Paths         []*Path         `json:"paths,omitempty"`
+	MultipathHops []*MultipathHop `json:"multipath_hops,omitempty"`
+	// addresses of the target, telling if the last hop is it
+	targets []string
 }
 
 // slightly simpler struct than the one provided by geoipc
@@ -42,67 +66,190 @@ type ReportLocation struct {
 	Longitude   float64 `json:"longitude"`
 }
 
-func NewReport(reportCycles int, host string, loc *ReportLocation) *Report {
-	report := &Report{}
+// Run mtr against ip, the address of host. When ctx is done first mtr
+// gets killed, the report having the probes it got to print.
+func NewReport(ctx context.Context, reportCycles int, host string, ip net.IP, opts *ProbeOptions, loc *ReportLocation) (*Report, error) {
+	report := &Report{Target: host}
 	report.Time = time.Now()
+	report.Probe = opts.effective(mtrDefaults)
+	// mtr only takes whole seconds
+	report.Probe.Timeout = math.Ceil(report.Probe.Timeout)
 
 	tstart := time.Now()
-	rawOutput, err := exec.Command(MTR_BIN, "--report", "-n", "-c", strconv.Itoa(reportCycles), host).
-		Output()
+	// raw mode so we get every probe sent and its RTT, not only the
+	// aggregates mtr prints in report mode
+	args := append([]string{"--raw", "-n", "-c", strconv.Itoa(reportCycles)}, egress.mtrArgs()...)
+	args = append(args, opts.mtrArgs()...)
+	rawOutput, err := exec.CommandContext(ctx, MTR_BIN, append(args, ip.String())...).Output()
 
-	if err != nil {
-		panic("Error running the mtr command")
+	// mtr flushes every line in raw mode, the output is there up to the
+	// kill
+	if ctx.Err() != nil {
+		report.Incomplete = true
+	} else if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return nil, fmt.Errorf("%s: %s", err, bytes.TrimSpace(exitErr.Stderr))
+	} else if err != nil {
+		return nil, err
 	}
 
-	buf := bytes.NewBuffer(rawOutput)
-	scanner := bufio.NewScanner(buf)
-	scanner.Split(bufio.ScanLines)
-	hopCount := 0
+	report.targets = []string{ip.String()}
+	report.Hosts = parseRawOutput(rawOutput, reportCycles, report.targets)
+	// hops below the first TTL weren't probed, keeping the target
+	for len(report.Hosts) > 1 && report.Hosts[0].Hop < report.Probe.FirstTTL && report.Hosts[0].IP == unknownHop {
+		report.Hosts = report.Hosts[1:]
+	}
+	report.Hops = lastHop(report).Hop
+	report.ElapsedTime = time.Since(tstart)
+	report.Location = loc
+	report.Egress = egress.report("")
 
-	for scanner.Scan() {
-		r, _ := regexp.Compile(`^\s+\d+\.`)
+	return report, nil
+}
+
+type rawHop struct {
+	ip string
+	// sequence numbers of the probes sent, in order
+	sent []int
+	// RTT by probe sequence number
+	rtts map[int]float64
+	// RTTs in the order received, for mtr versions not printing
+	// sequence numbers
+	replies []float64
+}
+
+// Parse the output of mtr --raw:
+//
+//	x <hop> <seq>          probe sent
+//	h <hop> <ip>           host replying at hop
+//	p <hop> <usec> [seq]   reply received
+//
+// Hops are 0 based. Other lines (DNS, etc) are ignored. When none of the
+// hops is one of the targets, an unknown hop is added after the last one
+// replying, so the target shows up with every probe lost.
+func parseRawOutput(output []byte, reportCycles int, targets []string) []*Host {
+	hops := map[int]*rawHop{}
+	maxHop := -1
 
-		line := scanner.Text()
-		if !r.MatchString(line) {
+	scanner := bufio.NewScanner(bytes.NewBuffer(output))
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 3 {
 			continue
 		}
-
-		tokens := strings.Fields(line)
-		sent, err := strconv.Atoi(tokens[3])
+		pos, err := strconv.Atoi(tokens[1])
 		if err != nil {
-			panic("Error parsing sent field")
+			continue
 		}
-
-		hopCount += 1
-		host := Host{
-			IP:   tokens[1],
-			Sent: sent,
-			Hop:  hopCount,
+		hop := hops[pos]
+		if hop == nil {
+			hop = &rawHop{rtts: map[int]float64{}}
+			hops[pos] = hop
 		}
 
-		f2F(strings.Replace(tokens[2], "%", "", -1), &host.LostPercent)
-		f2F(tokens[4], &host.Last)
-		f2F(tokens[5], &host.Avg)
-		f2F(tokens[6], &host.Best)
-		f2F(tokens[7], &host.Worst)
-		f2F(tokens[8], &host.StDev)
+		switch tokens[0] {
+		case "x":
+			if seq, err := strconv.Atoi(tokens[2]); err == nil {
+				hop.sent = append(hop.sent, seq)
+			}
+		case "h":
+			// load balanced hops may have several, keep the first one
+			// like mtr does in report mode
+			if hop.ip == "" {
+				hop.ip = tokens[2]
+			}
+			if pos > maxHop {
+				maxHop = pos
+			}
+		case "p":
+			usec, err := strconv.ParseFloat(tokens[2], 64)
+			if err != nil {
+				continue
+			}
+			rtt := usec / 1000
+			hop.replies = append(hop.replies, rtt)
+			if len(tokens) > 3 {
+				if seq, err := strconv.Atoi(tokens[3]); err == nil {
+					hop.rtts[seq] = rtt
+				}
+			}
+		}
+	}
 
-		report.Hosts = append(report.Hosts, &host)
+	// the target replies to every probe past its hop, trim there
+	last := maxHop
+	if last >= 0 {
+		for pos := 0; pos < last; pos++ {
+			if hops[pos] != nil && hops[pos].ip == hops[last].ip {
+				last = pos
+				break
+			}
+		}
 	}
 
-	report.Hops = len(report.Hosts)
-	report.ElapsedTime = time.Since(tstart)
-	report.Location = loc
+	hosts := []*Host{}
+	for pos := 0; pos <= last; pos++ {
+		hop := hops[pos]
+		if hop == nil {
+			hop = &rawHop{}
+		}
+		ip := hop.ip
+		if ip == "" {
+			ip = unknownHop
+		}
 
-	return report
-}
+		if len(hop.sent) == 0 {
+			// no sequence numbers, can't tell which probes timed out
+			host := newHostStats(ip, pos+1, reportCycles, hop.replies)
+			for i := range hop.replies {
+				host.Samples = append(host.Samples, &hop.replies[i])
+			}
+			hosts = append(hosts, host)
+			continue
+		}
+
+		samples := []float64{}
+		probes := []*float64{}
+		for _, seq := range hop.sent {
+			rtt, ok := hop.rtts[seq]
+			if !ok {
+				probes = append(probes, nil)
+				continue
+			}
+			samples = append(samples, rtt)
+			probes = append(probes, &rtt)
+		}
+		host := newHostStats(ip, pos+1, len(hop.sent), samples)
+		host.Samples = probes
+		hosts = append(hosts, host)
+	}
 
-func f2F(val string, field *float64) {
-	f, err := strconv.ParseFloat(val, 64)
-	*field = f
-	if err != nil {
-		panic("Error parsing field")
+	if len(targets) == 0 {
+		// couldn't resolve it, can't tell
+		return hosts
+	}
+	for _, h := range hosts {
+		for _, target := range targets {
+			if h.IP == target {
+				return hosts
+			}
+		}
 	}
+	// mtr kept probing past the last hop replying, the first hop it probed
+	// there is where the target would be
+	dest := -1
+	for pos, hop := range hops {
+		if pos > last && len(hop.sent) > 0 && (dest < 0 || pos < dest) {
+			dest = pos
+		}
+	}
+	if dest < 0 {
+		dest = last + 1
+	}
+	host := newHostStats(unknownHop, dest+1, reportCycles, nil)
+	host.Samples = make([]*float64, reportCycles)
+
+	return append(hosts, host)
 }
 
 func findMtrBin() string {
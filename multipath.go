@@ -0,0 +1,449 @@
+package main
+
+// Paris traceroute style multipath discovery.
+//
+// Load balancers pick the next hop hashing the flow identifiers (addresses,
+// protocol and ports), so a classic traceroute, changing the destination
+// port with every probe, mixes hops from different equal-cost paths.
+// Here every flow keeps its UDP ports constant for all its probes and the
+// source port changes from one flow to another, so each flow sticks to one
+// path and the set of flows enumerates the paths available.
+//
+// The TTL of a probe is encoded in its payload size, which load balancers
+// don't hash, so all the probes of a cycle can be in flight at once. The
+// probe at the max TTL is the packet size, every TTL below a byte less.
+// Reading the ICMP replies requires a raw socket (root or CAP_NET_RAW).
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	multipathDstPort = 33434
+	// between the probes of a cycle, not to hit the ICMP rate limits of
+	// the routers
+	multipathProbeGap = 5 * time.Millisecond
+	// what mtr prints for hops not replying
+	unknownHop = "???"
+)
+
+// A distinct path to the target and the flows that followed it
+type Path struct {
+	ID    int     `json:"id"`
+	Flows []int   `json:"flows"`
+	Hosts []*Host `json:"hosts"`
+}
+
+// One of the interfaces replying at a given hop and the paths it belongs to
+type HopInterface struct {
+	*Host
+	Paths []int `json:"paths"`
+}
+
+type MultipathHop struct {
+	Hop        int             `json:"hop-number"`
+	Interfaces []*HopInterface `json:"interfaces"`
+}
+
+type probeKey struct {
+	flow int
+	ttl  int
+}
+
+type multipathTracer struct {
+	opts *ProbeOptions
+	// payload of the probes, the TTL being added
+	base  int
+	dst   *net.UDPAddr
+	conns []*net.UDPConn
+	// source port -> flow
+	ports map[int]int
+	icmp  net.PacketConn
+
+	mu       sync.Mutex
+	inflight map[probeKey]time.Time
+	sent     map[probeKey]int
+	// RTT samples received for every probe, by replying interface
+	rtts map[probeKey]map[string][]float64
+	// lowest TTL the target replied to, by flow
+	destTTL map[int]int
+}
+
+func newMultipathTracer(ip net.IP, flows int, opts *ProbeOptions) (*multipathTracer, error) {
+	var err error
+	t := &multipathTracer{
+		opts:     opts,
+		base:     opts.PacketSize - udpOverhead - opts.MaxTTL,
+		dst:      &net.UDPAddr{IP: ip, Port: multipathDstPort},
+		ports:    map[int]int{},
+		inflight: map[probeKey]time.Time{},
+		sent:     map[probeKey]int{},
+		rtts:     map[probeKey]map[string][]float64{},
+		destTTL:  map[int]int{},
+	}
+
+	t.icmp, err = egress.listenPacket("ip4:icmp")
+	if err != nil {
+		return nil, fmt.Errorf("Error opening ICMP socket (root required): %s", err)
+	}
+
+	for i := 0; i < flows; i++ {
+		// every flow gets its own source port, constant for all its probes
+		pc, err := egress.listenPacket("udp4")
+		if err != nil {
+			t.close()
+			return nil, fmt.Errorf("Error opening UDP socket: %s", err)
+		}
+		conn := pc.(*net.UDPConn)
+		if opts.TOS != 0 {
+			if err := setSockoptInt(conn, syscall.IPPROTO_IP, syscall.IP_TOS, opts.TOS); err != nil {
+				conn.Close()
+				t.close()
+				return nil, fmt.Errorf("Error setting TOS: %s", err)
+			}
+		}
+		t.ports[conn.LocalAddr().(*net.UDPAddr).Port] = i
+		t.conns = append(t.conns, conn)
+	}
+
+	return t, nil
+}
+
+func (t *multipathTracer) close() {
+	t.icmp.Close()
+	for _, c := range t.conns {
+		c.Close()
+	}
+}
+
+func (t *multipathTracer) send(flow, ttl int) error {
+	conn := t.conns[flow]
+	if err := setSockoptInt(conn, syscall.IPPROTO_IP, syscall.IP_TTL, ttl); err != nil {
+		return err
+	}
+
+	key := probeKey{flow, ttl}
+	t.mu.Lock()
+	t.inflight[key] = time.Now()
+	t.sent[key]++
+	t.mu.Unlock()
+
+	_, err := conn.WriteTo(make([]byte, t.base+ttl), t.dst)
+	return err
+}
+
+func (t *multipathTracer) receive() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := t.icmp.ReadFrom(buf)
+		if err != nil {
+			// socket closed, we're done
+			return
+		}
+		now := time.Now()
+
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		var quote []byte
+		switch body := msg.Body.(type) {
+		case *icmp.TimeExceeded:
+			quote = body.Data
+		case *icmp.DstUnreach:
+			quote = body.Data
+		default:
+			continue
+		}
+
+		dst, srcPort, dstPort, udpLen, ok := parseUDPQuote(quote)
+		if !ok || !dst.Equal(t.dst.IP) || dstPort != multipathDstPort {
+			continue
+		}
+		flow, ok := t.ports[srcPort]
+		if !ok {
+			continue
+		}
+
+		key := probeKey{flow, udpLen - 8 - t.base}
+		ip := peer.(*net.IPAddr).IP.String()
+
+		t.mu.Lock()
+		if sentAt, ok := t.inflight[key]; ok {
+			delete(t.inflight, key)
+			if t.rtts[key] == nil {
+				t.rtts[key] = map[string][]float64{}
+			}
+			rtt := float64(now.Sub(sentAt)) / float64(time.Millisecond)
+			t.rtts[key][ip] = append(t.rtts[key][ip], rtt)
+
+			if ip == t.dst.IP.String() {
+				if d, ok := t.destTTL[flow]; !ok || key.ttl < d {
+					t.destTTL[flow] = key.ttl
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Highest TTL worth probing: once every flow reached the target there's
+// no point in going further.
+func (t *multipathTracer) maxTTL() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.destTTL) < len(t.conns) {
+		return t.opts.MaxTTL
+	}
+	max := 0
+	for _, d := range t.destTTL {
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+func (t *multipathTracer) pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.inflight)
+}
+
+// Send the probes of every cycle, until ctx is done. Cycles start the
+// probe interval apart, like mtr rounds.
+func (t *multipathTracer) run(ctx context.Context, cycles int) error {
+	interval := time.Duration(t.opts.Interval * float64(time.Second))
+	next := time.Now()
+	for cycle := 0; cycle < cycles; cycle++ {
+		if err := sleep(ctx, time.Until(next)); err != nil {
+			return err
+		}
+		next = time.Now().Add(interval)
+
+		maxTTL := t.maxTTL()
+		for ttl := t.opts.FirstTTL; ttl <= maxTTL; ttl++ {
+			for flow := range t.conns {
+				if err := t.send(flow, ttl); err != nil {
+					return fmt.Errorf("Error sending probe: %s", err)
+				}
+				if err := sleep(ctx, multipathProbeGap); err != nil {
+					return err
+				}
+			}
+		}
+
+		deadline := time.Now().Add(time.Duration(t.opts.Timeout * float64(time.Second)))
+		for t.pending() > 0 && time.Now().Before(deadline) {
+			if err := sleep(ctx, 10*time.Millisecond); err != nil {
+				return err
+			}
+		}
+
+		// late replies are accounted as lost
+		t.mu.Lock()
+		t.inflight = map[probeKey]time.Time{}
+		t.mu.Unlock()
+	}
+
+	return nil
+}
+
+// The interface that replied the most to a flow at a given hop
+func (t *multipathTracer) hopIP(flow, ttl int) string {
+	ip, max := unknownHop, 0
+	for candidate, rtts := range t.rtts[probeKey{flow, ttl}] {
+		if len(rtts) > max || (len(rtts) == max && candidate < ip) {
+			ip, max = candidate, len(rtts)
+		}
+	}
+	return ip
+}
+
+// Hop sequence followed by every flow, trimmed at the target
+func (t *multipathTracer) flowHops() [][]string {
+	hops := make([][]string, len(t.conns))
+	for flow := range t.conns {
+		last, ok := t.destTTL[flow]
+		if !ok {
+			// target never reached, stop at the last hop replying
+			for ttl := 1; ttl <= t.opts.MaxTTL; ttl++ {
+				if len(t.rtts[probeKey{flow, ttl}]) > 0 {
+					last = ttl
+				}
+			}
+		}
+		for ttl := 1; ttl <= last; ttl++ {
+			hops[flow] = append(hops[flow], t.hopIP(flow, ttl))
+		}
+	}
+	return hops
+}
+
+func (t *multipathTracer) report(report *Report) {
+	hops := t.flowHops()
+	report.targets = []string{t.dst.IP.String()}
+
+	// flows following the same hop sequence share a path, hops not
+	// replying matching any (see mergePaths)
+	pathHops := map[*Path][]string{}
+	for flow, h := range hops {
+		var path *Path
+		for _, p := range report.Paths {
+			if merged, ok := mergePaths(pathHops[p], h); ok {
+				path, pathHops[p] = p, merged
+				break
+			}
+		}
+		if path == nil {
+			path = &Path{}
+			pathHops[path] = h
+			report.Paths = append(report.Paths, path)
+		}
+		path.Flows = append(path.Flows, flow)
+	}
+	// most popular paths first
+	sort.SliceStable(report.Paths, func(i, j int) bool {
+		return len(report.Paths[i].Flows) > len(report.Paths[j].Flows)
+	})
+
+	maxHops := 0
+	for id, path := range report.Paths {
+		path.ID = id
+		if len(pathHops[path]) > maxHops {
+			maxHops = len(pathHops[path])
+		}
+		for i, ip := range pathHops[path] {
+			sent, samples := 0, []float64{}
+			for _, flow := range path.Flows {
+				key := probeKey{flow, i + 1}
+				sent += t.sent[key]
+				samples = append(samples, t.rtts[key][ip]...)
+			}
+			path.Hosts = append(path.Hosts, newHostStats(ip, i+1, sent, samples))
+		}
+	}
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		hop := &MultipathHop{Hop: ttl}
+		byIP := map[string]*HopInterface{}
+		samples := map[string][]float64{}
+		for _, path := range report.Paths {
+			if ttl > len(path.Hosts) {
+				continue
+			}
+			ip := path.Hosts[ttl-1].IP
+			iface := byIP[ip]
+			if iface == nil {
+				iface = &HopInterface{Host: &Host{IP: ip, Hop: ttl}}
+				byIP[ip] = iface
+				hop.Interfaces = append(hop.Interfaces, iface)
+			}
+			iface.Paths = append(iface.Paths, path.ID)
+			for _, flow := range path.Flows {
+				key := probeKey{flow, ttl}
+				iface.Sent += t.sent[key]
+				samples[ip] = append(samples[ip], t.rtts[key][ip]...)
+			}
+		}
+		for _, iface := range hop.Interfaces {
+			iface.Host = newHostStats(iface.IP, ttl, iface.Sent, samples[iface.IP])
+		}
+		report.MultipathHops = append(report.MultipathHops, hop)
+	}
+
+	// hops below the first TTL weren't probed
+	if skip := t.opts.FirstTTL - 1; skip > 0 {
+		for _, path := range report.Paths {
+			if skip > len(path.Hosts) {
+				skip = len(path.Hosts)
+			}
+			path.Hosts = path.Hosts[skip:]
+		}
+		if skip > len(report.MultipathHops) {
+			skip = len(report.MultipathHops)
+		}
+		report.MultipathHops = report.MultipathHops[skip:]
+	}
+
+	// keep the single path view for consumers not aware of multipath
+	if len(report.Paths) > 0 {
+		report.Hosts = report.Paths[0].Hosts
+	}
+}
+
+// Extract the destination, ports and UDP length of the probe quoted
+// in an ICMP error message (original IPv4 header + 8 bytes at least).
+func parseUDPQuote(b []byte) (dst net.IP, srcPort, dstPort, udpLen int, ok bool) {
+	if len(b) < 20 {
+		return nil, 0, 0, 0, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if b[9] != 17 || len(b) < ihl+8 {
+		return nil, 0, 0, 0, false
+	}
+	udp := b[ihl:]
+	dst = net.IP(b[16:20])
+	srcPort = int(udp[0])<<8 | int(udp[1])
+	dstPort = int(udp[2])<<8 | int(udp[3])
+	udpLen = int(udp[4])<<8 | int(udp[5])
+
+	return dst, srcPort, dstPort, udpLen, true
+}
+
+// Trace the route to host probing it with the given number of flows,
+// sending reportCycles probes per flow and hop. When ctx is done first,
+// the report has the replies received until then.
+func NewMultipathReport(ctx context.Context, reportCycles, flows int, host string, ip net.IP, opts *ProbeOptions, loc *ReportLocation) (*Report, error) {
+	report := &Report{Target: host}
+	report.Time = time.Now()
+	report.Probe = opts.effective(multipathDefaults)
+	if report.Probe.PacketSize == 0 {
+		report.Probe.PacketSize = udpOverhead + report.Probe.MaxTTL
+	}
+	tstart := time.Now()
+
+	t, err := newMultipathTracer(ip, flows, report.Probe)
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		t.receive()
+		wg.Done()
+	}()
+
+	err = t.run(ctx, reportCycles)
+	t.close()
+	wg.Wait()
+	if ctx.Err() != nil {
+		report.Incomplete = true
+	} else if err != nil {
+		return nil, err
+	}
+
+	t.report(report)
+	// the longest path, the flows landing on one or another from a
+	// report to the next don't change it
+	for _, p := range report.Paths {
+		if hops := lastHop(&Report{Hosts: p.Hosts, targets: report.targets}).Hop; hops > report.Hops {
+			report.Hops = hops
+		}
+	}
+	report.ElapsedTime = time.Since(tstart)
+	report.Location = loc
+	report.Egress = egress.report("")
+
+	return report, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Event sent when the hops to a target differ from the previous report
+type PathChange struct {
+	Type     string          `json:"type"`
+	Target   string          `json:"target"`
+	Time     time.Time       `json:"time"`
+	Before   []string        `json:"before"`
+	After    []string        `json:"after"`
+	Location *ReportLocation `json:"location"`
+	// multipath mode only, every path discovered, Before and After being
+	// the first ones
+	BeforePaths [][]string `json:"before_paths,omitempty"`
+	AfterPaths  [][]string `json:"after_paths,omitempty"`
+}
+
+// Remembers the last paths seen for every target, only one without
+// multipath
+type pathTracker struct {
+	mu    sync.Mutex
+	paths map[string][][]string
+}
+
+func newPathTracker() *pathTracker {
+	return &pathTracker{paths: map[string][][]string{}}
+}
+
+// Record the paths in report, returning a PathChange event if they differ
+// from the ones previously recorded for the same target.
+//
+// Hops not replying (???) match any hop: a hop failing to answer a few
+// probes doesn't mean the route changed. In multipath mode the flows land
+// on other equal-cost paths from one report to the next, the paths
+// discovered being compared as a set, the order they come in doesn't
+// matter.
+func (pt *pathTracker) update(report *Report) *PathChange {
+	after := reportPaths(report)
+	if len(after) == 0 {
+		// nothing replied, nothing to compare
+		return nil
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	before, seen := pt.paths[report.Target]
+	if !seen {
+		pt.paths[report.Target] = after
+		return nil
+	}
+
+	if merged, same := mergePathSets(before, after); same {
+		// remember the hops we've just learned
+		pt.paths[report.Target] = merged
+		return nil
+	}
+	pt.paths[report.Target] = after
+
+	ev := &PathChange{
+		Type:     "path-changed",
+		Target:   report.Target,
+		Time:     report.Time,
+		Before:   before[0],
+		After:    after[0],
+		Location: report.Location,
+	}
+	if len(report.Paths) > 0 {
+		ev.BeforePaths, ev.AfterPaths = before, after
+	}
+	return ev
+}
+
+// Hop sequences of the paths in report, the ones of no hop replying left
+// out
+func reportPaths(report *Report) [][]string {
+	hosts := [][]*Host{report.Hosts}
+	if len(report.Paths) > 0 {
+		hosts = nil
+		for _, p := range report.Paths {
+			hosts = append(hosts, p.Hosts)
+		}
+	}
+
+	paths := [][]string{}
+	for _, hs := range hosts {
+		hops := []string{}
+		for _, h := range hs {
+			hops = append(hops, h.IP)
+		}
+		// the target, or the last hops, not replying at all isn't a change
+		for len(hops) > 0 && hops[len(hops)-1] == unknownHop {
+			hops = hops[:len(hops)-1]
+		}
+		if len(hops) > 0 {
+			paths = append(paths, hops)
+		}
+	}
+	return paths
+}
+
+// Whether every path in before is one in after and the other way round,
+// merging them
+func mergePathSets(before, after [][]string) ([][]string, bool) {
+	merged := make([][]string, len(before))
+	for i, b := range before {
+		for _, a := range after {
+			if m, ok := mergePaths(b, a); ok {
+				merged[i] = m
+				break
+			}
+		}
+		if merged[i] == nil {
+			return nil, false
+		}
+	}
+	for _, a := range after {
+		found := false
+		for _, b := range before {
+			if _, ok := mergePaths(b, a); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+
+	return merged, true
+}
+
+// Whether both hop sequences are the same path, filling the hops not
+// replying in one of them with the ones known in the other.
+func mergePaths(before, after []string) ([]string, bool) {
+	if len(before) != len(after) {
+		return nil, false
+	}
+
+	merged := make([]string, len(after))
+	for i := range after {
+		switch {
+		case after[i] == unknownHop:
+			merged[i] = before[i]
+		case before[i] == unknownHop || before[i] == after[i]:
+			merged[i] = after[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return merged, true
+}
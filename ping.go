@@ -0,0 +1,236 @@
+package main
+
+// Ping tests, end-to-end reachability without tracing every hop.
+//
+//   "ping_tests": [
+//     {"target": "8.8.8.8", "count": 20, "size": 56, "dscp": 46, "interval": 60}
+//   ]
+//
+// Every run sends count (--count) echo requests with size (56) bytes of
+// payload, probe_interval (1000) milliseconds apart, marked with dscp (0)
+// when given. Replies taking more than timeout (2) seconds are lost.
+// The schedule (see schedule.go) and topic default to --repeat/--cron and
+// --ping-topic.
+//
+// --ping runs one for the target instead of mtr. Sending echo requests
+// requires a raw socket (root or CAP_NET_RAW).
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type PingTest struct {
+	Target string `json:"target"`
+	Count  int    `json:"count"`
+	Size   int    `json:"size"`
+	DSCP   int    `json:"dscp"`
+	Topic  string `json:"topic"`
+	Schedule
+	// milliseconds
+	ProbeInterval int `json:"probe_interval"`
+	// seconds
+	Timeout int `json:"timeout"`
+}
+
+// Kept small, there may be a lot of these
+type PingResult struct {
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	IP       string    `json:"ip"`
+	Size     int       `json:"size"`
+	DSCP     int       `json:"dscp,omitempty"`
+	Sent     int       `json:"sent"`
+	Received int       `json:"received"`
+	// percent
+	Loss float64 `json:"loss"`
+	// milliseconds
+	Min      float64         `json:"min"`
+	Avg      float64         `json:"avg"`
+	Max      float64         `json:"max"`
+	StDev    float64         `json:"stdev"`
+	Jitter   float64         `json:"jitter"`
+	Samples  []*float64      `json:"samples,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Location *ReportLocation `json:"location"`
+	Egress   *Egress         `json:"egress,omitempty"`
+	// interrupted, sent counts the requests sent until then
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+func (t *PingTest) validate() error {
+	if t.Target == "" {
+		return errors.New("Ping test without target")
+	}
+	if t.Count < 0 {
+		return fmt.Errorf("Invalid count in ping test %s", t.Target)
+	}
+	if err := t.Schedule.validate(); err != nil {
+		return fmt.Errorf("Invalid ping test %s: %s", t.Target, err)
+	}
+	if t.DSCP < 0 || t.DSCP > 63 {
+		return fmt.Errorf("Invalid DSCP %d in ping test %s, 0-63 expected", t.DSCP, t.Target)
+	}
+	if t.Size < 0 || t.Size > 65507-8 {
+		return fmt.Errorf("Invalid size %d in ping test %s", t.Size, t.Target)
+	}
+	if t.Size == 0 {
+		t.Size = 56
+	}
+	if t.ProbeInterval <= 0 {
+		t.ProbeInterval = 1000
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = 2
+	}
+
+	return nil
+}
+
+// Send test.Count echo requests to the target, or as many as possible
+// before ctx is done
+func pingTest(ctx context.Context, test *PingTest) *PingResult {
+	res := &PingResult{
+		Time:   time.Now(),
+		Target: test.Target,
+		Size:   test.Size,
+		DSCP:   test.DSCP,
+		Sent:   test.Count,
+		Loss:   100,
+		Egress: egress.report(""),
+	}
+
+	ip, err := resolveIP4(ctx, test.Target)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.IP = ip.String()
+	addr := &net.IPAddr{IP: ip}
+
+	pc, err := egress.listenPacket("ip4:icmp")
+	if err != nil {
+		res.Error = fmt.Sprintf("Error opening ICMP socket (root required): %s", err)
+		return res
+	}
+	conn := pc.(*net.IPConn)
+	defer conn.Close()
+	if test.DSCP > 0 {
+		// DSCP is the upper 6 bits of the TOS byte
+		if err := setSockoptInt(conn, syscall.IPPROTO_IP, syscall.IP_TOS, test.DSCP<<2); err != nil {
+			res.Error = fmt.Sprintf("Error setting DSCP: %s", err)
+			return res
+		}
+	}
+
+	// tell our replies from those to other ping tests
+	id := rand.Intn(1 << 16)
+	timeout := time.Duration(test.Timeout) * time.Second
+
+	var mu sync.Mutex
+	sentAt := make([]time.Time, test.Count)
+	rtts := make([]*float64, test.Count)
+	received := 0
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, test.Size+1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				// socket closed, we're done
+				return
+			}
+			now := time.Now()
+
+			msg, err := icmp.ParseMessage(1, buf[:n])
+			if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok || echo.ID != id || !peer.(*net.IPAddr).IP.Equal(addr.IP) {
+				continue
+			}
+
+			mu.Lock()
+			seq := echo.Seq
+			if seq < len(sentAt) && !sentAt[seq].IsZero() && rtts[seq] == nil && now.Sub(sentAt[seq]) <= timeout {
+				rtt := float64(now.Sub(sentAt[seq])) / float64(time.Millisecond)
+				rtts[seq] = &rtt
+				received++
+			}
+			mu.Unlock()
+		}
+	}()
+
+	payload := make([]byte, test.Size)
+	sent := 0
+	for seq := 0; seq < test.Count; seq++ {
+		if seq > 0 {
+			if sleep(ctx, time.Duration(test.ProbeInterval)*time.Millisecond) != nil {
+				break
+			}
+		}
+
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			res.Error = err.Error()
+			break
+		}
+
+		mu.Lock()
+		sentAt[seq] = time.Now()
+		mu.Unlock()
+		if _, err := conn.WriteTo(b, addr); err != nil {
+			res.Error = fmt.Sprintf("Error sending echo request: %s", err)
+		}
+		sent++
+	}
+
+	// wait for the replies still in flight
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		all := received == sent
+		mu.Unlock()
+		if all || sleep(ctx, 10*time.Millisecond) != nil {
+			break
+		}
+	}
+	conn.Close()
+	<-done
+
+	rtts = rtts[:sent]
+	samples := []float64{}
+	for _, rtt := range rtts {
+		if rtt != nil {
+			samples = append(samples, *rtt)
+		}
+	}
+	stats := newHostStats(res.IP, 0, sent, samples)
+	res.Sent = sent
+	res.Incomplete = ctx.Err() != nil
+	res.Received = len(samples)
+	res.Loss = stats.LostPercent
+	res.Min = stats.Best
+	res.Avg = stats.Avg
+	res.Max = stats.Worst
+	res.StDev = stats.StDev
+	res.Jitter = stats.Jitter
+	res.Samples = rtts
+
+	return res
+}
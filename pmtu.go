@@ -0,0 +1,279 @@
+package main
+
+// Path MTU discovery, looking for MTU black holes.
+//
+// UDP probes with the DF bit set are sent to the target, binary searching
+// the biggest one getting through (the target replying port unreachable).
+// Routers that can't forward a probe should reply fragmentation needed,
+// with the MTU of the next hop; these replies are recorded along with the
+// router sending them. Probes bigger than the path MTU vanishing with no
+// such reply reveal a black hole.
+//
+// Like multipath, reading the ICMP replies requires a raw socket.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// smallest MTU IPv4 links must support, and biggest jumbo frames
+	pmtuMinSize  = 68
+	pmtuMaxSize  = 9000
+	pmtuBasePort = 33434
+	pmtuTimeout  = time.Second
+	// probes vanishing could be plain packet loss
+	pmtuTries = 2
+	// IPv4 and UDP headers
+	udpOverhead = 28
+)
+
+type PathMTU struct {
+	// bytes, the biggest IP packet reaching the target
+	MTU    int `json:"mtu"`
+	Probes int `json:"probes"`
+	// probes bigger than the MTU got lost without anyone telling why
+	BlackHole  bool          `json:"black_hole"`
+	FragNeeded []*FragNeeded `json:"frag_needed,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	// cancelled before the search was over, the MTU is a lower bound
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// ICMP fragmentation needed received for a probe
+type FragNeeded struct {
+	IP string `json:"ip"`
+	// hop of the mtr report with that IP, if any
+	Hop        int `json:"hop,omitempty"`
+	NextHopMTU int `json:"next_hop_mtu"`
+	ProbeSize  int `json:"probe_size"`
+}
+
+type pmtuReply struct {
+	seq        int
+	fits       bool
+	fragNeeded *FragNeeded
+}
+
+type pmtuProber struct {
+	dst     net.IP
+	conn    *net.UDPConn
+	port    int
+	icmp    net.PacketConn
+	replies chan pmtuReply
+	seq     int
+	probes  int
+}
+
+func newPMTUProber(ip net.IP) (*pmtuProber, error) {
+	var err error
+	p := &pmtuProber{
+		dst:     ip,
+		replies: make(chan pmtuReply, 16),
+	}
+
+	p.icmp, err = egress.listenPacket("ip4:icmp")
+	if err != nil {
+		return nil, fmt.Errorf("Error opening ICMP socket (root required): %s", err)
+	}
+	pc, err := egress.listenPacket("udp4")
+	if err != nil {
+		p.icmp.Close()
+		return nil, fmt.Errorf("Error opening UDP socket: %s", err)
+	}
+	p.conn = pc.(*net.UDPConn)
+	p.port = p.conn.LocalAddr().(*net.UDPAddr).Port
+
+	if err := setDontFragment(p.conn); err != nil {
+		p.close()
+		return nil, fmt.Errorf("Error setting DF: %s", err)
+	}
+
+	return p, nil
+}
+
+func (p *pmtuProber) close() {
+	p.icmp.Close()
+	p.conn.Close()
+}
+
+func (p *pmtuProber) receive() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := p.icmp.ReadFrom(buf)
+		if err != nil {
+			// socket closed, we're done
+			return
+		}
+
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeDestinationUnreachable {
+			continue
+		}
+		body, ok := msg.Body.(*icmp.DstUnreach)
+		if !ok {
+			continue
+		}
+		dst, srcPort, dstPort, _, ok := parseUDPQuote(body.Data)
+		if !ok || !dst.Equal(p.dst) || srcPort != p.port {
+			continue
+		}
+
+		reply := pmtuReply{seq: dstPort - pmtuBasePort}
+		ip := peer.(*net.IPAddr).IP
+		switch {
+		case msg.Code == 3 && ip.Equal(p.dst):
+			// port unreachable, made it to the target
+			reply.fits = true
+		case msg.Code == 4:
+			// the next hop MTU goes in the last 2 bytes of the header
+			// (RFC 1191), not parsed by the icmp package
+			reply.fragNeeded = &FragNeeded{
+				IP:         ip.String(),
+				NextHopMTU: int(binary.BigEndian.Uint16(buf[6:8])),
+			}
+		default:
+			continue
+		}
+
+		select {
+		case p.replies <- reply:
+		default:
+		}
+	}
+}
+
+// Send a probe making an IP packet of size bytes, telling whether it got
+// to the target or who said it was too big. Errors mean it couldn't be
+// sent, EMSGSIZE when bigger than the MTU of the local interface, or ctx
+// is done.
+func (p *pmtuProber) probe(ctx context.Context, size int) (bool, *FragNeeded, error) {
+	for try := 0; try < pmtuTries; try++ {
+		p.seq++
+		p.probes++
+		dst := &net.UDPAddr{IP: p.dst, Port: pmtuBasePort + p.seq}
+		if _, err := p.conn.WriteTo(make([]byte, size-udpOverhead), dst); err != nil {
+			return false, nil, err
+		}
+
+		timeout := time.After(pmtuTimeout)
+	wait:
+		for {
+			select {
+			case r := <-p.replies:
+				if r.seq != p.seq {
+					// late reply to a previous probe
+					continue
+				}
+				if r.fragNeeded != nil {
+					r.fragNeeded.ProbeSize = size
+				}
+				return r.fits, r.fragNeeded, nil
+			case <-timeout:
+				break wait
+			case <-ctx.Done():
+				return false, nil, ctx.Err()
+			}
+		}
+	}
+
+	return false, nil, nil
+}
+
+func discoverPathMTU(ctx context.Context, ip net.IP) *PathMTU {
+	res := &PathMTU{}
+
+	p, err := newPMTUProber(ip)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer p.close()
+	go p.receive()
+
+	if ok, _, err := p.probe(ctx, pmtuMinSize); !ok {
+		res.Probes = p.probes
+		if ctx.Err() != nil {
+			res.Incomplete = true
+			res.Error = fmt.Sprintf("Interrupted: %s", ctx.Err())
+		} else if err != nil {
+			res.Error = fmt.Sprintf("Error sending probe: %s", err)
+		} else {
+			res.Error = fmt.Sprintf("%s not replying to UDP probes", ip)
+		}
+		return res
+	}
+
+	lo, hi, next := pmtuMinSize, pmtuMaxSize, 0
+	vanished := false
+	for lo < hi {
+		size := (lo + hi + 1) / 2
+		if next > 0 {
+			size, next = next, 0
+		}
+
+		ok, frag, err := p.probe(ctx, size)
+		switch {
+		case errors.Is(err, syscall.EMSGSIZE):
+			hi = size - 1
+		case ctx.Err() != nil:
+			res.MTU = lo
+			res.Probes = p.probes
+			res.Incomplete = true
+			return res
+		case err != nil:
+			res.Error = fmt.Sprintf("Error sending probe: %s", err)
+			res.Probes = p.probes
+			return res
+		case ok:
+			lo = size
+		case frag != nil:
+			res.addFragNeeded(frag)
+			hi = size - 1
+			// nothing bigger gets past that router, try right away the
+			// MTU it told us
+			if frag.NextHopMTU > lo && frag.NextHopMTU < size {
+				hi = frag.NextHopMTU
+				next = frag.NextHopMTU
+			}
+		default:
+			vanished = true
+			hi = size - 1
+		}
+	}
+
+	res.MTU = lo
+	res.Probes = p.probes
+	res.BlackHole = vanished && len(res.FragNeeded) == 0
+
+	return res
+}
+
+// Record frag, once per router and MTU
+func (m *PathMTU) addFragNeeded(frag *FragNeeded) {
+	for _, f := range m.FragNeeded {
+		if f.IP == frag.IP && f.NextHopMTU == frag.NextHopMTU {
+			return
+		}
+	}
+	m.FragNeeded = append(m.FragNeeded, frag)
+}
+
+// Tell the hops sending fragmentation needed from the report hosts
+func (m *PathMTU) setHops(hosts []*Host) {
+	for _, frag := range m.FragNeeded {
+		for _, host := range hosts {
+			if host.IP == frag.IP {
+				frag.Hop = host.Hop
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Probe settings of the target, passed to mtr or used by the multipath
+// engine. Zero values mean the engine defaults, the reports record the
+// values in effect.
+type ProbeOptions struct {
+	// bytes, IP packet. Multipath probes shrink by their TTL from there,
+	// the one at the max TTL being this size.
+	PacketSize int `json:"packet_size"`
+	TOS        int `json:"tos"`
+	// seconds between cycles, every hop is probed once a cycle
+	Interval float64 `json:"interval"`
+	FirstTTL int     `json:"first_ttl"`
+	MaxTTL   int     `json:"max_ttl"`
+	// seconds to wait for a reply
+	Timeout float64 `json:"timeout"`
+}
+
+var mtrDefaults = ProbeOptions{
+	PacketSize: 64,
+	Interval:   1,
+	FirstTTL:   1,
+	MaxTTL:     30,
+	Timeout:    10,
+}
+
+var multipathDefaults = ProbeOptions{
+	// the smallest encoding every TTL in the UDP payload, see
+	// NewMultipathReport
+	PacketSize: 0,
+	Interval:   1,
+	FirstTTL:   1,
+	MaxTTL:     30,
+	Timeout:    2,
+}
+
+func (o *ProbeOptions) validate() error {
+	if o.PacketSize != 0 && (o.PacketSize < udpOverhead+1 || o.PacketSize > 65535-255) {
+		return fmt.Errorf("Invalid packet size %d", o.PacketSize)
+	}
+	if o.TOS < 0 || o.TOS > 255 {
+		return fmt.Errorf("Invalid TOS %d, 0-255 expected", o.TOS)
+	}
+	if o.Interval < 0 || o.Timeout < 0 {
+		return fmt.Errorf("Invalid probe interval or timeout")
+	}
+	if o.FirstTTL < 0 || o.MaxTTL < 0 || o.MaxTTL > 255 {
+		return fmt.Errorf("Invalid first or max TTL")
+	}
+	if o.FirstTTL > 0 && o.MaxTTL > 0 && o.FirstTTL > o.MaxTTL {
+		return fmt.Errorf("First TTL %d beyond max TTL %d", o.FirstTTL, o.MaxTTL)
+	}
+
+	return nil
+}
+
+// Multipath probes need a byte of UDP payload per TTL
+func (o *ProbeOptions) validateMultipath() error {
+	maxTTL := o.MaxTTL
+	if maxTTL == 0 {
+		maxTTL = multipathDefaults.MaxTTL
+	}
+	if o.PacketSize != 0 && o.PacketSize < udpOverhead+maxTTL {
+		return fmt.Errorf("Packet size %d too small for multipath probes up to TTL %d, %d at least", o.PacketSize, maxTTL, udpOverhead+maxTTL)
+	}
+	return nil
+}
+
+// Copy of the options with the defaults d filled in
+func (o *ProbeOptions) effective(d ProbeOptions) *ProbeOptions {
+	e := *o
+	if e.PacketSize == 0 {
+		e.PacketSize = d.PacketSize
+	}
+	if e.Interval == 0 {
+		e.Interval = d.Interval
+	}
+	if e.FirstTTL == 0 {
+		e.FirstTTL = d.FirstTTL
+	}
+	if e.MaxTTL == 0 {
+		e.MaxTTL = d.MaxTTL
+	}
+	if e.Timeout == 0 {
+		e.Timeout = d.Timeout
+	}
+	return &e
+}
+
+// mtr flags for the options set, leaving the rest to mtr
+func (o *ProbeOptions) mtrArgs() []string {
+	args := []string{}
+	if o.PacketSize != 0 {
+		args = append(args, "-s", strconv.Itoa(o.PacketSize))
+	}
+	if o.TOS != 0 {
+		args = append(args, "-Q", strconv.Itoa(o.TOS))
+	}
+	if o.Interval != 0 {
+		// below 1 second requires root
+		args = append(args, "-i", strconv.FormatFloat(o.Interval, 'f', -1, 64))
+	}
+	if o.FirstTTL != 0 {
+		args = append(args, "-f", strconv.Itoa(o.FirstTTL))
+	}
+	if o.MaxTTL != 0 {
+		args = append(args, "-m", strconv.Itoa(o.MaxTTL))
+	}
+	if o.Timeout != 0 {
+		// whole seconds only
+		args = append(args, "-Z", strconv.Itoa(int(math.Ceil(o.Timeout))))
+	}
+	return args
+}
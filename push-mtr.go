@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 	log "github.com/Sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v1"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -17,60 +22,212 @@ var (
 	MTR_BIN    = "/usr/bin/mtr"
 )
 
-func runUrlGet(scheme, host, topic string, stdout bool, loc *ReportLocation) {
-	// if empty, do skip this test
-	if scheme == "" {
-		log.Debug("Skipping URL test, no scheme given")
-		return
-	}
+// Send v as JSON to the MQTT topic, or print it when stdout is set
+func publishJSON(topic string, v interface{}, stdout bool) bool {
+	var msg []byte
+	var err error
 
-	testResult, err := wget(scheme+"://"+host, "", true)
+	if stdout {
+		// pretty format for stdout, we don't wanna do this when
+		// sending it over the wire, almost doubles the message size
+		msg, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		msg, err = json.Marshal(v)
+	}
 	if err != nil {
-		log.Errorf("Error getting download URL metrics: %s\n", err)
-		return
+		log.Warnf("Error marshaling json")
+		return false
 	}
-	testResult.Location = loc
 
-	var msg []byte
 	if stdout {
-		msg, err = json.MarshalIndent(testResult, "", "  ")
 		fmt.Println(string(msg))
-	} else {
-		msg, err = json.Marshal(testResult)
-		log.Debugf("Sending URL Get report to %s", topic)
-		if !pushMsg(topic, string(msg)) {
-			log.Errorf("Error running URL get test")
+		return true
+	}
+
+	log.Debugf("Sending message to %s", topic)
+	return pushMsg(topic, string(msg))
+}
+
+func runThroughputTest(ctx context.Context, test *ThroughputTest, stdout bool, loc *ReportLocation) {
+	result := throughputTest(ctx, test)
+	result.Location = loc
+	if result.Error != "" {
+		log.Errorf("Error running throughput test for %s: %s", test.URL, result.Error)
+	}
+
+	if !publishJSON(test.Topic, result, stdout) {
+		log.Errorf("Error sending throughput test results")
+	}
+}
+
+func runDNSTest(ctx context.Context, test *DNSTest, stdout bool, loc *ReportLocation) {
+	timeout := time.Duration(test.Timeout) * time.Second
+	for _, name := range test.Names {
+		for _, resolver := range test.Resolvers {
+			if ctx.Err() != nil {
+				log.Warnf("DNS test of %s interrupted", strings.Join(test.Names, ", "))
+				return
+			}
+			result := dnsQuery(ctx, name, test.Type, resolver, timeout)
+			result.Location = loc
+			if result.Error != "" {
+				log.Errorf("Error resolving %s with %s: %s", name, resolver, result.Error)
+			}
+
+			if !publishJSON(test.Topic, result, stdout) {
+				log.Errorf("Error sending DNS test results")
+			}
 		}
 	}
 }
 
-func runMtrReport(count int, host string, loc *ReportLocation, stdout bool, topic string) {
-	r := NewReport(count, host, loc)
-	var msg []byte
-	var err error
+func runTCPTest(ctx context.Context, test *TCPTest, stdout, samples bool, loc *ReportLocation) {
+	result := tcpConnectTest(ctx, test)
+	result.Location = loc
+	if result.Stats.LostPercent == 100 {
+		log.Errorf("Error connecting to %s: %s", test.Address, result.Error)
+	}
+	if !samples {
+		result.Stats.Samples = nil
+	}
 
-	if stdout {
-		// pretty format for stdout, we don't wanna do this when
-		// sending it over the wire, almost doubles the message size
-		msg, err = json.MarshalIndent(r, "", "  ")
-	} else {
-		msg, err = json.Marshal(r)
+	if !publishJSON(test.Topic, result, stdout) {
+		log.Errorf("Error sending TCP connect test results")
+	}
+}
+
+func runPingTest(ctx context.Context, test *PingTest, stdout, samples bool, loc *ReportLocation) {
+	result := pingTest(ctx, test)
+	result.Location = loc
+	if result.Error != "" {
+		log.Errorf("Error pinging %s: %s", test.Target, result.Error)
 	}
+	if !samples {
+		result.Samples = nil
+	}
+
+	if !publishJSON(test.Topic, result, stdout) {
+		log.Errorf("Error sending ping test results")
+	}
+}
+
+func runUrlGet(ctx context.Context, check *URLCheck, stdout bool, loc *ReportLocation) {
+	start := time.Now()
+	testResult, err := wget(ctx, check)
 	if err != nil {
-		log.Warnf("Error marshaling json")
+		log.Errorf("Error getting download URL metrics: %s\n", err)
+		// tell why when it's the certificate
+		tlsInfo := inspectTLS(ctx, check.URL, check.Proxy)
+		if check.Assert == nil && tlsInfo == nil {
+			return
+		}
+		// a synthetic check failing is a result too
+		testResult = UrlTestResult{
+			URL:        check.URL,
+			TimeStart:  start,
+			Error:      strings.TrimSpace(err.Error()),
+			TLS:        tlsInfo,
+			Egress:     egress.report(check.Proxy),
+			Incomplete: ctx.Err() != nil,
+		}
+		if check.Assert != nil {
+			passed := false
+			testResult.Passed = &passed
+		}
+	}
+	testResult.Location = loc
+	if !check.Assets {
+		testResult.Assets = nil
 	}
 
-	if stdout {
-		fmt.Println(string(msg))
+	if !publishJSON(check.Topic, testResult, stdout) {
+		log.Errorf("Error running URL get test")
+	}
+
+	info := testResult.TLS
+	if info != nil && check.CertWarnDays >= 0 && info.DaysToExpiry < check.CertWarnDays {
+		log.Warnf("Certificate of %s expires in %d days", check.URL, info.DaysToExpiry)
+		publishJSON(check.CertTopic, &CertWarning{
+			URL:          check.URL,
+			Subject:      info.Subject,
+			Issuer:       info.Issuer,
+			NotAfter:     info.NotAfter,
+			DaysToExpiry: info.DaysToExpiry,
+			Threshold:    check.CertWarnDays,
+			Time:         start,
+			Location:     loc,
+		}, stdout)
+	}
+}
+
+// Trace the route to host with mtr, or probing that many flows, adding the
+// VoIP score and the path MTU when asked for
+func traceTarget(ctx context.Context, count, flows int, host string, opts *ProbeOptions, codec *Codec, loc *ReportLocation, pathMTU bool) (*Report, error) {
+	var r *Report
+
+	// resolved once, mtr, the multipath and path MTU probes and telling if
+	// the target replied all go by the same address
+	ip, err := resolveIP4(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving %s: %s", host, err)
+	}
+
+	// discovered while tracing, the probes don't get in each other's way
+	var pmtu chan *PathMTU
+	if pathMTU {
+		pmtu = make(chan *PathMTU, 1)
+		go func() { pmtu <- discoverPathMTU(ctx, ip) }()
+	}
+
+	if flows > 0 {
+		r, err = NewMultipathReport(ctx, count, flows, host, ip, opts, loc)
+		if err != nil {
+			return nil, fmt.Errorf("Error running multipath test: %s", err)
+		}
 	} else {
-		if !pushMsg(topic, string(msg)) {
-			log.Errorf("Error running mtr test")
+		r, err = NewReport(ctx, count, host, ip, opts, loc)
+		if err != nil {
+			return nil, fmt.Errorf("Error running mtr: %s", err)
+		}
+	}
+
+	r.VoIP = voipScore(lastHop(r), codec)
+
+	if pmtu != nil {
+		r.PathMTU = <-pmtu
+		r.PathMTU.setHops(r.Hosts)
+		if r.PathMTU.Error != "" {
+			log.Errorf("Error discovering the path MTU: %s", r.PathMTU.Error)
+		}
+	}
+
+	return r, nil
+}
+
+func runMtrReport(ctx context.Context, count, flows int, host string, opts *ProbeOptions, codec *Codec, loc *ReportLocation, stdout, samples, pathMTU bool, topic string) *Report {
+	r, err := traceTarget(ctx, count, flows, host, opts, codec, loc, pathMTU)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	if !samples {
+		for _, h := range r.Hosts {
+			h.Samples = nil
 		}
 	}
+
+	if !publishJSON(topic, r, stdout) {
+		log.Errorf("Error running mtr test")
+	}
+
+	return r
 }
 
 func main() {
 	kingpin.Version(PKG_VERSION)
+	kingpin.CommandLine.Help = "Flags go before the command: push-mtr [<flags>] <command> [<args>]. " +
+		"push-mtr [<flags>] <host>, from before the commands, still publishes."
 
 	count := kingpin.Flag("count", "Report cycles (mtr -c)").
 		Default("10").Int()
@@ -81,13 +238,33 @@ func main() {
 	urlGetTopic := kingpin.Flag("url-get-topic", "MTTQ topic").Default("/metrics/url-get").
 		String()
 
-	host := kingpin.Arg("host", "Target host").Required().String()
+	// the target, run and publish only
+	host := new(string)
+
+	runCmd := kingpin.Command("run", "Trace the route to the target once and print the report as a table")
+	runCmd.Arg("host", "Target host").Required().StringVar(host)
+
+	publishCmd := kingpin.Command("publish", "Test the target and publish the results to the MQTT brokers")
+	publishCmd.Arg("host", "Target host").Required().StringVar(host)
+
+	kingpin.Command("check-broker", "Check the connection, TLS and authentication to the MQTT brokers")
+
+	kingpin.Command("locate", "Print the location the results are reported from")
 
 	repeat := kingpin.Flag("repeat", "Send the report every X seconds").
 		Default("0").Int()
 
-	brokerUrls := kingpin.Flag("broker-urls", "Comman separated MQTT broker URLs").
-		Required().Default("").OverrideDefaultFromEnvar("MQTT_URLS").String()
+	cron := kingpin.Flag("cron", "Send the report on this cron schedule, instead of every --repeat seconds").
+		String()
+
+	startOffset := kingpin.Flag("start-offset", "Delay the scheduled reports by a random offset, up to X seconds").
+		Default("0").Int()
+
+	scheduleJitter := kingpin.Flag("schedule-jitter", "Delay every scheduled report by up to X more random seconds").
+		Default("0").Int()
+
+	brokerUrls := kingpin.Flag("broker-urls", "Comman separated MQTT broker URLs (publish and check-broker)").
+		Default("").OverrideDefaultFromEnvar("MQTT_URLS").String()
 
 	stdout := kingpin.Flag("stdout", "Print the report to stdout").
 		Default("false").Bool()
@@ -109,13 +286,113 @@ func main() {
 
 	clientID := kingpin.Flag("clientid", "Use a custom MQTT client ID").String()
 
-	furlGet := kingpin.Flag("url-get", "Report URL GET metrics").String()
+	furlGet := kingpin.Flag("url-get", "Report URL GET metrics for the target host using this scheme, or for this URL").String()
+
+	urlAssets := kingpin.Flag("url-assets", "Include every linked asset in the URL GET report").
+		Default("false").Bool()
+
+	urlSaveDir := kingpin.Flag("url-save-dir", "Save the pages and assets URL GET tests download here, for debugging").
+		String()
 
-	kingpin.Parse()
+	multipathFlows := kingpin.Flag("multipath-flows", "Discover equal-cost paths probing N flows instead of running mtr (0 disables)").
+		Default("0").Int()
 
-	log.Info("Starting push-mtr")
+	certWarningTopic := kingpin.Flag("cert-warning-topic", "MTTQ topic for certificate expiry warnings").
+		Default("/events/cert-expiry").String()
 
-	var err error
+	pathChangeTopic := kingpin.Flag("path-change-topic", "MTTQ topic for path change events").
+		Default("/events/path-changed").String()
+
+	configFile := kingpin.Flag("config", "JSON config file (alert rules, etc)").
+		String()
+
+	rawSamples := kingpin.Flag("raw-samples", "Include the RTT of every probe sent in the report").
+		Default("false").Bool()
+
+	sourceAddress := kingpin.Flag("source-address", "Send the probes from this IP address").
+		String()
+
+	iface := kingpin.Flag("interface", "Send the probes through this network interface").
+		String()
+
+	proxyURL := kingpin.Flag("proxy", "HTTP, HTTPS or SOCKS5 proxy for the URL GET tests").
+		String()
+
+	throughputURL := kingpin.Flag("throughput-url", "Measure the download throughput of this URL").
+		String()
+
+	throughputStreams := kingpin.Flag("throughput-streams", "Parallel downloads in throughput tests").
+		Default("4").Int()
+
+	throughputDuration := kingpin.Flag("throughput-duration", "Download for X seconds in throughput tests, instead of once").
+		Default("0").Int()
+
+	throughputTopic := kingpin.Flag("throughput-topic", "MTTQ topic for throughput tests").
+		Default("/metrics/throughput").String()
+
+	dnsTopic := kingpin.Flag("dns-topic", "MTTQ topic for DNS tests").
+		Default("/metrics/dns").String()
+
+	tcpTopic := kingpin.Flag("tcp-topic", "MTTQ topic for TCP connect tests").
+		Default("/metrics/tcp-connect").String()
+
+	pingOnly := kingpin.Flag("ping", "Only ping the target instead of tracing the route with mtr").
+		Default("false").Bool()
+
+	pingTopic := kingpin.Flag("ping-topic", "MTTQ topic for ping tests").
+		Default("/metrics/ping").String()
+
+	pathMTU := kingpin.Flag("path-mtu", "Discover the path MTU to the target with every report").
+		Default("false").Bool()
+
+	packetSize := kingpin.Flag("packet-size", "Size of the probes sent to the target in bytes (mtr -s)").
+		Default("0").Int()
+
+	tos := kingpin.Flag("tos", "TOS byte of the probes, DSCP << 2 (mtr -Q)").
+		Default("0").Int()
+
+	probeInterval := kingpin.Flag("probe-interval", "Seconds between cycles of probes (mtr -i)").
+		Default("0").Float()
+
+	firstTTL := kingpin.Flag("first-ttl", "TTL to start probing at (mtr -f)").
+		Default("0").Int()
+
+	maxTTL := kingpin.Flag("max-ttl", "Maximum TTL probed (mtr -m)").
+		Default("0").Int()
+
+	probeTimeout := kingpin.Flag("probe-timeout", "Seconds to wait for a probe reply (mtr -Z)").
+		Default("0").Float()
+
+	shutdownTimeout := kingpin.Flag("shutdown-timeout", "Seconds to wait for the tests in progress when stopping").
+		Default("30").Int()
+
+	testTimeout := kingpin.Flag("test-timeout", "Cancel tests running for more than X seconds, publishing what they got (0, the default, disables)").
+		Default("0").Int()
+
+	// push-mtr [<flags>] <host> was all there was before the commands, the
+	// host being last
+	args := os.Args[1:]
+	command, err := kingpin.CommandLine.Parse(args)
+	if err != nil && len(args) > 0 && err.Error() == fmt.Sprintf("no such command '%s'", args[len(args)-1]) {
+		log.Warnf("No command given, use push-mtr [<flags>] publish %s", args[len(args)-1])
+		args = append(args[:len(args)-1:len(args)-1], "publish", args[len(args)-1])
+		command, err = kingpin.CommandLine.Parse(args)
+	}
+	command = kingpin.MustParse(command, err)
+	if command == "" {
+		kingpin.Usage()
+		os.Exit(0)
+	}
+
+	if (command == "publish" || command == "check-broker") && *brokerUrls == "" {
+		kingpin.Fatalf("required flag --broker-urls not provided, try --help")
+	}
+	if (command == "publish" || command == "check-broker") && !sameCredentials(parseBrokerUrls(*brokerUrls)) {
+		kingpin.Fatalf("the brokers in --broker-urls must share the same credentials, or none")
+	}
+	if command == "publish" {
+		log.Info("Starting push-mtr")
+	}
 
 	if *debug {
 		log.SetLevel(log.DebugLevel)
@@ -142,12 +419,105 @@ func main() {
 		}
 	}
 
+	switch command {
+	case "locate":
+		loc, err := findLocation(*location)
+		if err != nil {
+			log.Fatalf("Geocoding of location %s failed: %s", *location, err)
+		}
+		if loc.IP == "" {
+			log.Warn("IP geolocation failed")
+		}
+		publishJSON("", loc, true)
+		return
+	case "check-broker":
+		if !checkBrokers(parseBrokerUrls(*brokerUrls), *clientID, newTlsConfig(*cafile, *insecure)) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	egress = &Egress{SourceAddress: *sourceAddress, Interface: *iface, Proxy: *proxyURL}
+	if err := egress.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	probe := &ProbeOptions{
+		PacketSize: *packetSize,
+		TOS:        *tos,
+		Interval:   *probeInterval,
+		FirstTTL:   *firstTTL,
+		MaxTTL:     *maxTTL,
+		Timeout:    *probeTimeout,
+	}
+	if err := probe.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if *multipathFlows > 0 {
+		if err := probe.validateMultipath(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	schedule := &Schedule{
+		Interval:    *repeat,
+		Cron:        *cron,
+		StartOffset: *startOffset,
+		Jitter:      *scheduleJitter,
+		Deadline:    *testTimeout,
+	}
+	if err := schedule.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	MTR_BIN = findMtrBin()
-	if MTR_BIN == "" {
+	if MTR_BIN == "" && *multipathFlows == 0 && !*pingOnly {
 		fmt.Fprintf(os.Stderr, "mtr command not found in path\n")
 		os.Exit(1)
 	}
 
+	// the target itself, with --ping
+	targetPing := &PingTest{
+		Target:        *host,
+		DSCP:          probe.TOS >> 2,
+		ProbeInterval: int(probe.Interval * 1000),
+		Timeout:       int(math.Ceil(probe.Timeout)),
+	}
+	if probe.PacketSize != 0 {
+		// ICMP header, not UDP, but just as long
+		targetPing.Size = probe.PacketSize - udpOverhead
+	}
+	if err := targetPing.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if command == "run" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+		if *testTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(*testTimeout)*time.Second)
+			defer cancel()
+		}
+
+		if *pingOnly {
+			targetPing.Count = *count
+			printPingTable(os.Stdout, pingTest(ctx, targetPing))
+			return
+		}
+		r, err := traceTarget(ctx, *count, *multipathFlows, *host, probe, &config.VoIP, nil, *pathMTU)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printReportTable(os.Stdout, r)
+		return
+	}
+
 	loc, err := findLocation(*location)
 	if err != nil {
 		log.Fatalf("Geocoding of location %s failed: %s", *location, err)
@@ -158,17 +528,177 @@ func main() {
 	tlsConfig := newTlsConfig(*cafile, *insecure)
 	mqttClient, err = newMqttClient(urlList, clientID, tlsConfig)
 
-	runTests := func() {
-		go runUrlGet(*furlGet, *host, *urlGetTopic, *stdout, loc)
-		go runMtrReport(*count, *host, loc, *stdout, *topic)
+	paths := newPathTracker()
+	alerts := newAlertEvaluator(config.Alerts.Rules)
+	anomalies := newAnomalyDetector(&config.Anomalies)
+
+	if *urlSaveDir != "" {
+		if err := os.MkdirAll(*urlSaveDir, 0755); err != nil {
+			log.Fatalf("Error creating %s: %s", *urlSaveDir, err)
+		}
 	}
 
-	if *repeat != 0 {
-		timer := time.NewTicker(time.Duration(*repeat) * time.Second)
-		for range timer.C {
-			runTests()
+	urlChecks := config.URLChecks
+	if *furlGet != "" {
+		u := *furlGet
+		if !strings.Contains(u, "://") {
+			// just the scheme, GET the mtr target
+			u += "://" + *host
 		}
-	} else {
-		runTests()
+		check := &URLCheck{URL: u}
+		if err := check.validate(); err != nil {
+			log.Fatal(err)
+		}
+		urlChecks = append(urlChecks, check)
+	}
+	for _, check := range urlChecks {
+		if check.Topic == "" {
+			check.Topic = *urlGetTopic
+		}
+		if check.CertTopic == "" {
+			check.CertTopic = *certWarningTopic
+		}
+		check.Schedule.defaults(schedule)
+		check.Assets = check.Assets || *urlAssets
+		if check.SaveDir == "" {
+			check.SaveDir = *urlSaveDir
+		}
+		if check.Proxy == "" {
+			check.Proxy = egress.Proxy
+		}
+	}
+
+	throughputTests := config.ThroughputTests
+	if *throughputURL != "" {
+		test := &ThroughputTest{
+			URL:      *throughputURL,
+			Streams:  *throughputStreams,
+			Duration: *throughputDuration,
+		}
+		if err := test.validate(); err != nil {
+			log.Fatal(err)
+		}
+		throughputTests = append(throughputTests, test)
+	}
+	for _, test := range throughputTests {
+		if test.Topic == "" {
+			test.Topic = *throughputTopic
+		}
+		test.Schedule.defaults(schedule)
+		if test.Proxy == "" {
+			test.Proxy = egress.Proxy
+		}
+	}
+
+	for _, test := range config.DNSTests {
+		if test.Topic == "" {
+			test.Topic = *dnsTopic
+		}
+		test.Schedule.defaults(schedule)
 	}
+
+	for _, test := range config.TCPTests {
+		if test.Topic == "" {
+			test.Topic = *tcpTopic
+		}
+		test.Schedule.defaults(schedule)
+		if test.Count == 0 {
+			test.Count = *count
+		}
+	}
+
+	for _, test := range append(config.PingTests, targetPing) {
+		if test.Topic == "" {
+			test.Topic = *pingTopic
+		}
+		test.Schedule.defaults(schedule)
+		if test.Count == 0 {
+			test.Count = *count
+		}
+	}
+
+	mtrTest := func(ctx context.Context) {
+		r := runMtrReport(ctx, *count, *multipathFlows, *host, probe, &config.VoIP, loc, *stdout, *rawSamples, *pathMTU, *topic)
+		// a partial trace would look like a path change or loss
+		if r == nil || r.Incomplete {
+			return
+		}
+		if ev := paths.update(r); ev != nil {
+			log.Infof("Path to %s changed", r.Target)
+			publishJSON(*pathChangeTopic, ev, *stdout)
+		}
+		for _, a := range alerts.evaluate(r) {
+			log.Infof("Alert %s %s for %s", a.Rule, a.State, a.Target)
+			publishJSON(config.Alerts.Topic, a, *stdout)
+		}
+		if !config.Anomalies.Enabled {
+			return
+		}
+		for _, a := range anomalies.evaluate(r) {
+			log.Infof("Anomaly in %s to %s, score %0.2f", a.Metric, a.Target, a.Score)
+			publishJSON(config.Anomalies.Topic, a, *stdout)
+		}
+	}
+
+	targetTest := mtrTest
+	if *pingOnly {
+		targetTest = func(ctx context.Context) { runPingTest(ctx, targetPing, *stdout, *rawSamples, loc) }
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	// closed once every test is done, one-shot runs only
+	var finished <-chan struct{}
+	// tests on a schedule keep us running, the others run once
+	scheduled := false
+	start := func(s *Schedule, name string, test func(context.Context)) {
+		if s.scheduled() {
+			scheduled = true
+			go s.run(name, test)
+		} else {
+			s.once(test)
+		}
+	}
+	for _, check := range urlChecks {
+		check := check
+		start(&check.Schedule, check.URL, func(ctx context.Context) { runUrlGet(ctx, check, *stdout, loc) })
+	}
+	for _, test := range throughputTests {
+		test := test
+		start(&test.Schedule, test.URL, func(ctx context.Context) { runThroughputTest(ctx, test, *stdout, loc) })
+	}
+	for _, test := range config.DNSTests {
+		test := test
+		start(&test.Schedule, strings.Join(test.Names, ","), func(ctx context.Context) { runDNSTest(ctx, test, *stdout, loc) })
+	}
+	for _, test := range config.TCPTests {
+		test := test
+		start(&test.Schedule, test.Address, func(ctx context.Context) { runTCPTest(ctx, test, *stdout, *rawSamples, loc) })
+	}
+	for _, test := range config.PingTests {
+		test := test
+		start(&test.Schedule, test.Target, func(ctx context.Context) { runPingTest(ctx, test, *stdout, *rawSamples, loc) })
+	}
+	start(schedule, *host, targetTest)
+	if !scheduled {
+		finished = runner.done()
+	}
+
+	select {
+	case <-finished:
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+		runner.shutdown()
+		if !runner.wait(time.Duration(*shutdownTimeout) * time.Second) {
+			log.Warnf("Tests still running after %d seconds, cancelling them", *shutdownTimeout)
+			runner.cancel()
+			// they publish what they got so far
+			runner.wait(5 * time.Second)
+		}
+	}
+
+	// QoS 1 messages have been acknowledged already, quiesce briefly
+	mqttClient.Disconnect(250)
+	log.Info("Stopping push-mtr")
 }
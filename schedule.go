@@ -0,0 +1,258 @@
+package main
+
+// Test schedules, every interval seconds or on a cron expression.
+//
+//   "interval": 300, "start_offset": 60, "jitter": 10, "deadline": 120
+//   "cron": "*/5 8-18 * * 1-5", "start_offset": 60
+//
+// start_offset shifts every run of the test by a random delay, up to that
+// many seconds, picked once, so agents sharing a schedule don't all fire
+// at the same second. jitter adds a different random delay to every run.
+// A run is skipped when the previous one is still in progress, and with a
+// deadline (--test-timeout, none by default) cancelled after that many
+// seconds, publishing what it got so far marked as incomplete.
+//
+// Cron expressions have the usual 5 fields (minute, hour, day of month,
+// month and day of week) with lists, ranges and steps, in local time.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Schedule struct {
+	// seconds
+	Interval    int    `json:"interval"`
+	Cron        string `json:"cron"`
+	StartOffset int    `json:"start_offset"`
+	Jitter      int    `json:"jitter"`
+	Deadline    int    `json:"deadline"`
+
+	cron *cronSchedule
+}
+
+func (s *Schedule) validate() error {
+	if s.Interval < 0 || s.StartOffset < 0 || s.Jitter < 0 || s.Deadline < 0 {
+		return errors.New("Invalid interval, start offset, jitter or deadline")
+	}
+	if s.Cron == "" {
+		return nil
+	}
+
+	var err error
+	if s.cron, err = parseCron(s.Cron); err != nil {
+		return fmt.Errorf("Invalid cron expression '%s': %s", s.Cron, err)
+	}
+	if _, ok := s.cron.next(time.Now()); !ok {
+		return fmt.Errorf("Invalid cron expression '%s': never fires", s.Cron)
+	}
+	return nil
+}
+
+// Fill in what's not set from d
+func (s *Schedule) defaults(d *Schedule) {
+	if s.Interval == 0 && s.Cron == "" {
+		s.Interval = d.Interval
+		s.Cron = d.Cron
+		s.cron = d.cron
+	}
+	if s.StartOffset == 0 {
+		s.StartOffset = d.StartOffset
+	}
+	if s.Jitter == 0 {
+		s.Jitter = d.Jitter
+	}
+	if s.Deadline == 0 {
+		s.Deadline = d.Deadline
+	}
+}
+
+// Run test once in the background, false when shutting down
+func (s *Schedule) once(test func(context.Context)) bool {
+	return runner.start(time.Duration(s.Deadline)*time.Second, test)
+}
+
+// Whether there's a schedule, or the test runs once
+func (s *Schedule) scheduled() bool {
+	return s.cron != nil || s.Interval > 0
+}
+
+func randomDelay(seconds int) time.Duration {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(seconds) * int64(time.Second)))
+}
+
+// Run test on schedule until shutting down, name being used for logging.
+// Runs it once without a schedule.
+func (s *Schedule) run(name string, test func(context.Context)) {
+	if !s.scheduled() {
+		s.once(test)
+		return
+	}
+
+	var running int32
+	fire := func() {
+		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+			log.Warnf("Previous %s run still in progress, skipping", name)
+			return
+		}
+		started := s.once(func(ctx context.Context) {
+			defer atomic.StoreInt32(&running, 0)
+			test(ctx)
+		})
+		if !started {
+			atomic.StoreInt32(&running, 0)
+		}
+	}
+
+	start := time.Now()
+	offset := randomDelay(s.StartOffset)
+	last := start
+	for i := 1; ; i++ {
+		var at time.Time
+		if s.cron != nil {
+			at, _ = s.cron.next(last)
+			last = at
+		} else {
+			at = start.Add(time.Duration(i*s.Interval) * time.Second)
+		}
+
+		select {
+		case <-time.After(time.Until(at.Add(offset + randomDelay(s.Jitter)))):
+			fire()
+		case <-runner.stop:
+			return
+		}
+	}
+}
+
+type cronSchedule struct {
+	// bit sets of the values matching every field
+	minute, hour, dom, month, dow uint64
+	// day of month or week restricted, any of them matching is enough
+	// when both are
+	domAny, dowAny bool
+}
+
+// Parse a field of a cron expression, values going from min to max
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range in '%s'", part)
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 to the end
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("5 fields expected")
+	}
+
+	c := &cronSchedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// both 0 and 7 are Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	return c, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// First time matching the expression after t, false if there is none for
+// decades
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Feb 29 on a Monday can be decades away, never is even further
+	limit := t.AddDate(30, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+
+	return limit, false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr, from, next string
+	}{
+		// steps
+		{"*/15 * * * *", "2024-09-11 10:00", "2024-09-11 10:15"},
+		{"5/15 * * * *", "2024-09-11 10:06", "2024-09-11 10:20"},
+		{"5/15 * * * *", "2024-09-11 10:50", "2024-09-11 11:05"},
+		{"0-30/20 * * * *", "2024-09-11 10:21", "2024-09-11 11:00"},
+		{"0 9-17/4 * * *", "2024-09-11 13:00", "2024-09-11 17:00"},
+		{"0,45 8 * * *", "2024-09-11 08:00", "2024-09-11 08:45"},
+		// a new year
+		{"30 23 31 12 *", "2024-12-31 23:30", "2025-12-31 23:30"},
+		// day of month or week restricted alone
+		{"0 0 10 * *", "2024-09-11 00:00", "2024-10-10 00:00"},
+		{"0 0 * * 1", "2024-09-11 00:00", "2024-09-16 00:00"},
+		// both restricted, any of them matching is enough
+		{"0 0 10 * 5", "2024-09-07 00:00", "2024-09-10 00:00"},
+		{"0 0 10 * 5", "2024-09-10 00:00", "2024-09-13 00:00"},
+		{"0 0 1 * 3", "2024-09-30 00:00", "2024-10-01 00:00"},
+		// Sunday as 0 or 7
+		{"0 12 * * 0", "2024-09-11 00:00", "2024-09-15 12:00"},
+		{"0 12 * * 7", "2024-09-11 00:00", "2024-09-15 12:00"},
+		{"0 12 * * 6-7", "2024-09-14 13:00", "2024-09-15 12:00"},
+		// Feb 29
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 29 2 *", "2024-02-28 12:00", "2024-02-29 00:00"},
+	}
+
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		from, _ := time.ParseInLocation("2006-01-02 15:04", test.from, time.Local)
+		next, ok := c.next(from)
+		if got := next.Format("2006-01-02 15:04"); !ok || got != test.next {
+			t.Errorf("%s from %s: %s %v, %s expected", test.expr, test.from, got, ok, test.next)
+		}
+	}
+}
+
+func TestCronNever(t *testing.T) {
+	for _, expr := range []string{"0 0 30 2 *", "0 0 31 2 *", "0 0 31 4,6,9,11 *"} {
+		c, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("%s: %s", expr, err)
+			continue
+		}
+		if next, ok := c.next(time.Now()); ok {
+			t.Errorf("%s: fires at %s", expr, next)
+		}
+
+		s := &Schedule{Cron: expr}
+		if err := s.validate(); err == nil || !strings.Contains(err.Error(), "never fires") {
+			t.Errorf("%s: error %v", expr, err)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("'%s' accepted", expr)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+// Lifecycle of the tests. One-shot runs wait for every test to publish its
+// results before exiting. SIGTERM and SIGINT stop the schedules, tests in
+// progress get --shutdown-timeout seconds to finish and publish, then they
+// are cancelled, publishing what they got so far, and we disconnect from
+// the broker.
+//
+// Results are published as soon as a test ends, waiting for the broker to
+// acknowledge them, there's no spool to flush.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type testRunner struct {
+	mu      sync.Mutex
+	running sync.WaitGroup
+	stopped bool
+	// closed when shutting down, interrupting the schedules
+	stop chan struct{}
+	// parent of the test contexts, cancelled when giving up on them
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var runner = newTestRunner()
+
+func newTestRunner() *testRunner {
+	r := &testRunner{stop: make(chan struct{})}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r
+}
+
+// Run test in the background, unless shutting down. Its context is
+// cancelled after timeout, if any.
+func (r *testRunner) start(timeout time.Duration, test func(context.Context)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return false
+	}
+
+	ctx, cancel := r.ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		defer cancel()
+		test(ctx)
+	}()
+	return true
+}
+
+// Don't start any more tests
+func (r *testRunner) shutdown() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+	}
+}
+
+// Closed once the tests started are done. With schedules running, only
+// meaningful after shutdown.
+func (r *testRunner) done() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// Wait for the tests in progress, false if some didn't finish in time
+func (r *testRunner) wait(timeout time.Duration) bool {
+	select {
+	case <-r.done():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Sleep for d, unless ctx is done first
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"syscall"
+)
+
+// Set an integer socket option on conn.
+//
+// golang.org/x/net/ipv4 would do but the vendored version can't find
+// the file descriptors of current net.Conn implementations.
+func setSockoptInt(conn syscall.Conn, level, opt, value int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
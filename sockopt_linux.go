@@ -0,0 +1,15 @@
+package main
+
+import (
+	"syscall"
+)
+
+func bindToDevice(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
+
+// Set DF on the packets sent, ignoring the path MTU the kernel learnt so
+// far so probes bigger than that still go out
+func setDontFragment(conn syscall.Conn) error {
+	return setSockoptInt(conn, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToDevice(fd uintptr, iface string) error {
+	return errors.New("binding to an interface is only supported on Linux")
+}
+
+func setDontFragment(conn syscall.Conn) error {
+	return errors.New("path MTU discovery is only supported on Linux")
+}
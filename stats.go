@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Summarize the RTT samples (in milliseconds) gathered for a hop into the
+// aggregates mtr prints in its reports, plus percentiles and jitter.
+//
+// sent is the number of probes sent, samples the RTTs of the probes that
+// got a reply, in the order they were sent.
+func newHostStats(ip string, hop, sent int, samples []float64) *Host {
+	host := &Host{
+		IP:   ip,
+		Hop:  hop,
+		Sent: sent,
+	}
+
+	if sent > 0 {
+		host.LostPercent = float64(sent-len(samples)) / float64(sent) * 100
+	}
+
+	if len(samples) == 0 {
+		return host
+	}
+
+	host.Last = samples[len(samples)-1]
+	host.Best = samples[0]
+	host.Worst = samples[0]
+	sum := 0.0
+	for _, s := range samples {
+		sum += s
+		host.Best = math.Min(host.Best, s)
+		host.Worst = math.Max(host.Worst, s)
+	}
+	host.Avg = sum / float64(len(samples))
+
+	variance := 0.0
+	for _, s := range samples {
+		variance += (s - host.Avg) * (s - host.Avg)
+	}
+	host.StDev = math.Sqrt(variance / float64(len(samples)))
+
+	for i := 1; i < len(samples); i++ {
+		host.Jitter += math.Abs(samples[i] - samples[i-1])
+	}
+	if len(samples) > 1 {
+		host.Jitter /= float64(len(samples) - 1)
+	}
+
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+	host.P50 = percentile(sorted, 50)
+	host.P90 = percentile(sorted, 90)
+	host.P95 = percentile(sorted, 95)
+	host.P99 = percentile(sorted, 99)
+
+	return host
+}
+
+// Percentile p (0-100) of the sorted samples, interpolating linearly
+// between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
@@ -0,0 +1,131 @@
+package main
+
+// TCP connect tests, timing the handshake to services filtering ICMP
+// where a full HTTP request is overkill (databases, SMTP, ...).
+//
+//   "tcp_tests": [
+//     {"address": "db.example.com:5432", "count": 10, "interval": 60}
+//   ]
+//
+// Every run connects count (--count) times, probe_interval (1000)
+// milliseconds apart, a connection not established within timeout (2)
+// seconds being lost. The schedule (see schedule.go) and topic default to
+// --repeat/--cron and --tcp-topic.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+type TCPTest struct {
+	Address string `json:"address"`
+	Count   int    `json:"count"`
+	Topic   string `json:"topic"`
+	Schedule
+	// milliseconds
+	ProbeInterval int `json:"probe_interval"`
+	// seconds
+	Timeout int `json:"timeout"`
+}
+
+type TCPConnectResult struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Port   int       `json:"port"`
+	// connect times in milliseconds, with the IP we connected to
+	Stats *Host `json:"stats"`
+	// why the last failed connection failed
+	Error       string          `json:"error,omitempty"`
+	ElapsedTime time.Duration   `json:"elapsed_time"`
+	Incomplete  bool            `json:"incomplete,omitempty"`
+	Location    *ReportLocation `json:"location"`
+	Egress      *Egress         `json:"egress,omitempty"`
+}
+
+func (t *TCPTest) validate() error {
+	host, port, err := net.SplitHostPort(t.Address)
+	if err != nil || host == "" {
+		return fmt.Errorf("Invalid TCP test address '%s', host:port expected", t.Address)
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("Invalid port in TCP test address '%s'", t.Address)
+	}
+	if t.Count < 0 {
+		return fmt.Errorf("Invalid count in TCP test %s", t.Address)
+	}
+	if err := t.Schedule.validate(); err != nil {
+		return fmt.Errorf("Invalid TCP test %s: %s", t.Address, err)
+	}
+	if t.ProbeInterval <= 0 {
+		t.ProbeInterval = 1000
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = 2
+	}
+
+	return nil
+}
+
+// Connect test.Count times, or until ctx is done
+func tcpConnectTest(ctx context.Context, test *TCPTest) *TCPConnectResult {
+	host, port, _ := net.SplitHostPort(test.Address)
+	res := &TCPConnectResult{
+		Time:   time.Now(),
+		Target: host,
+		Egress: egress.report(""),
+	}
+	res.Port, _ = strconv.Atoi(port)
+	tstart := time.Now()
+
+	// resolve once so every probe goes to the same address
+	addr, err := resolveTCP(ctx, host, port)
+	if err != nil {
+		res.Error = err.Error()
+		res.Stats = newHostStats(unknownHop, 0, test.Count, nil)
+		res.ElapsedTime = time.Since(tstart)
+		return res
+	}
+
+	dialer := egress.dialer("tcp")
+	samples := []float64{}
+	probes := []*float64{}
+	for i := 0; i < test.Count; i++ {
+		if i > 0 {
+			if sleep(ctx, time.Duration(test.ProbeInterval)*time.Millisecond) != nil {
+				break
+			}
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, time.Duration(test.Timeout)*time.Second)
+		start := time.Now()
+		conn, err := dialer.DialContext(pctx, "tcp", addr.String())
+		rtt := float64(time.Since(start)) / float64(time.Millisecond)
+		cancel()
+		if ctx.Err() != nil {
+			// interrupted, not lost
+			if conn != nil {
+				conn.Close()
+			}
+			break
+		}
+		if err != nil {
+			res.Error = err.Error()
+			probes = append(probes, nil)
+			continue
+		}
+		conn.Close()
+
+		samples = append(samples, rtt)
+		probes = append(probes, &rtt)
+	}
+
+	res.Stats = newHostStats(addr.IP.String(), 0, len(probes), samples)
+	res.Stats.Samples = probes
+	res.ElapsedTime = time.Since(tstart)
+	res.Incomplete = len(probes) < test.Count
+
+	return res
+}
@@ -0,0 +1,293 @@
+package main
+
+// Bulk download throughput tests, measuring bandwidth rather than how long
+// a page takes to load.
+//
+//   "throughput_tests": [
+//     {"url": "https://speed.example.com/100MB.bin", "streams": 4, "duration": 10, "interval": 3600}
+//   ]
+//
+// The object is downloaded by streams (4) parallel requests, each one over
+// its own connection. With a duration (seconds) every stream downloads it
+// over and over until the time is up, otherwise only once, cut off after
+// timeout (120) seconds. The schedule (see schedule.go) and topic default
+// to --repeat/--cron and --throughput-topic, proxy to --proxy.
+//
+// The aggregate rate is sampled every throughputSampleInterval, steady
+// state being reached once steadyStateSamples consecutive samples are
+// within steadyStateTolerance of their mean.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	throughputSampleInterval = 250 * time.Millisecond
+	steadyStateSamples       = 4
+	steadyStateTolerance     = 0.1
+)
+
+type ThroughputTest struct {
+	URL     string `json:"url"`
+	Topic   string `json:"topic"`
+	Streams int    `json:"streams"`
+	Schedule
+	// seconds
+	Duration int    `json:"duration"`
+	Timeout  int    `json:"timeout"`
+	Proxy    string `json:"proxy"`
+}
+
+type ThroughputResult struct {
+	URL       string          `json:"url"`
+	Location  *ReportLocation `json:"location"`
+	TimeStart time.Time       `json:"time_start"`
+	Streams   int             `json:"streams"`
+	// nanoseconds
+	Duration    int64   `json:"duration"`
+	Bytes       int64   `json:"bytes"`
+	Mbps        float64 `json:"mbps"`
+	SteadyState bool    `json:"steady_state"`
+	// nanoseconds since the start, and the rate from then on
+	SteadyStateTime int64           `json:"steady_state_time,omitempty"`
+	SteadyStateMbps float64         `json:"steady_state_mbps,omitempty"`
+	StreamResults   []*StreamResult `json:"stream_results"`
+	Error           string          `json:"error,omitempty"`
+	Incomplete      bool            `json:"incomplete,omitempty"`
+	Egress          *Egress         `json:"egress,omitempty"`
+}
+
+type StreamResult struct {
+	Stream int `json:"stream"`
+	// times the object was downloaded, duration mode only downloads it
+	// more than once
+	Requests int   `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+	// nanoseconds, the TTFB of the first request only
+	Duration int64   `json:"duration"`
+	TTFB     int64   `json:"ttfb"`
+	Mbps     float64 `json:"mbps"`
+	Error    string  `json:"error,omitempty"`
+}
+
+func (t *ThroughputTest) validate() error {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid throughput test %s: %s", t.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("Invalid throughput test %s: only http and https supported", t.URL)
+	}
+	if t.Duration < 0 {
+		return fmt.Errorf("Invalid duration in throughput test %s", t.URL)
+	}
+	if err := t.Schedule.validate(); err != nil {
+		return fmt.Errorf("Invalid throughput test %s: %s", t.URL, err)
+	}
+	if t.Streams <= 0 {
+		t.Streams = 4
+	}
+	if t.Timeout <= 0 {
+		t.Timeout = 120
+	}
+	if t.Proxy != "" {
+		if _, err := parseProxy(t.Proxy); err != nil {
+			return fmt.Errorf("Invalid throughput test %s: %s", t.URL, err)
+		}
+	}
+
+	return nil
+}
+
+func mbps(bytes, nanoseconds int64) float64 {
+	return throughput(bytes, nanoseconds) * 8 / 1e6
+}
+
+// Writer adding what's written to a counter shared by all the streams
+type atomicCounter struct {
+	n *int64
+}
+
+func (c *atomicCounter) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.n, int64(len(p)))
+	return len(p), nil
+}
+
+func downloadStream(ctx context.Context, client *http.Client, test *ThroughputTest, s *StreamResult, total *int64) {
+	start := time.Now()
+	defer func() {
+		s.Duration = time.Since(start).Nanoseconds()
+		s.Mbps = mbps(s.Bytes, s.Duration)
+	}()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", test.URL, nil)
+		if err != nil {
+			s.Error = err.Error()
+			return
+		}
+		reqStart := time.Now()
+		resp, err := client.Do(req)
+		if err == nil {
+			if s.Requests == 0 {
+				s.TTFB = time.Since(reqStart).Nanoseconds()
+			}
+			if resp.StatusCode >= 400 {
+				err = fmt.Errorf("HTTP status %d", resp.StatusCode)
+			} else {
+				var n int64
+				n, err = io.Copy(&atomicCounter{total}, resp.Body)
+				s.Bytes += n
+			}
+			resp.Body.Close()
+		}
+		s.Requests++
+
+		if test.Duration > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// time's up, not an error
+			return
+		}
+		if err != nil {
+			s.Error = err.Error()
+			return
+		}
+		if test.Duration == 0 {
+			return
+		}
+	}
+}
+
+// Index of the first sample of the steady state, given the total bytes
+// downloaded at every sample
+func steadyState(totals []int64) (int, bool) {
+	rates := make([]float64, len(totals))
+	var prev int64
+	for i, total := range totals {
+		rates[i] = float64(total - prev)
+		prev = total
+	}
+
+	for i := 0; i+steadyStateSamples <= len(rates); i++ {
+		window := rates[i : i+steadyStateSamples]
+		mean := 0.0
+		for _, r := range window {
+			mean += r
+		}
+		mean /= float64(len(window))
+		if mean == 0 {
+			continue
+		}
+
+		steady := true
+		for _, r := range window {
+			if r < mean*(1-steadyStateTolerance) || r > mean*(1+steadyStateTolerance) {
+				steady = false
+				break
+			}
+		}
+		if steady {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// Download test.URL until its duration is over, or the download done, or
+// parent is done
+func throughputTest(parent context.Context, test *ThroughputTest) ThroughputResult {
+	res := ThroughputResult{
+		URL:       test.URL,
+		Streams:   test.Streams,
+		TimeStart: time.Now(),
+		Egress:    egress.report(test.Proxy),
+	}
+
+	transport, err := egress.transport(test.Proxy)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	// HTTP/2 would multiplex the streams over a single connection
+	transport.ForceAttemptHTTP2 = false
+	// count the bytes on the wire
+	transport.DisableCompression = true
+	transport.MaxIdleConnsPerHost = test.Streams
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	timeout := time.Duration(test.Timeout) * time.Second
+	if test.Duration > 0 {
+		timeout = time.Duration(test.Duration) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	var total int64
+	totals := []int64{}
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(throughputSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				totals = append(totals, atomic.LoadInt64(&total))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < test.Streams; i++ {
+		s := &StreamResult{Stream: i}
+		res.StreamResults = append(res.StreamResults, s)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			downloadStream(ctx, client, test, s, &total)
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-sampled
+
+	res.Duration = time.Since(res.TimeStart).Nanoseconds()
+	res.Bytes = atomic.LoadInt64(&total)
+	res.Mbps = mbps(res.Bytes, res.Duration)
+	// the downloads cut short, not the duration being over
+	res.Incomplete = parent.Err() != nil || (test.Duration == 0 && ctx.Err() != nil)
+
+	if i, ok := steadyState(totals); ok {
+		var before int64
+		if i > 0 {
+			before = totals[i-1]
+		}
+		res.SteadyState = true
+		res.SteadyStateTime = int64(i) * throughputSampleInterval.Nanoseconds()
+		res.SteadyStateMbps = mbps(res.Bytes-before, res.Duration-res.SteadyStateTime)
+	}
+
+	if res.Bytes == 0 {
+		res.Error = "Nothing downloaded"
+		for _, s := range res.StreamResults {
+			if s.Error != "" {
+				res.Error = s.Error
+				break
+			}
+		}
+	}
+
+	return res
+}
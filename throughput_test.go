@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Server of a random blob, counting the requests
+func blobServer(t *testing.T, size int) (*httptest.Server, []byte, *int64) {
+	blob := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(blob)
+
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(blob)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, blob, &requests
+}
+
+func TestThroughputSingle(t *testing.T) {
+	srv, blob, requests := blobServer(t, 1<<20)
+	test := &ThroughputTest{URL: srv.URL, Streams: 3, Timeout: 10}
+
+	res := throughputTest(context.Background(), test)
+
+	if res.Error != "" {
+		t.Fatalf("error %s", res.Error)
+	}
+	if res.Incomplete {
+		t.Error("incomplete")
+	}
+	if want := int64(test.Streams * len(blob)); res.Bytes != want {
+		t.Errorf("%d bytes downloaded, %d expected", res.Bytes, want)
+	}
+	if n := atomic.LoadInt64(requests); n != int64(test.Streams) {
+		t.Errorf("%d requests, %d expected", n, test.Streams)
+	}
+	for _, s := range res.StreamResults {
+		if s.Requests != 1 || s.Bytes != int64(len(blob)) {
+			t.Errorf("stream %d: %d requests, %d bytes", s.Stream, s.Requests, s.Bytes)
+		}
+	}
+}
+
+func TestThroughputDuration(t *testing.T) {
+	srv, _, requests := blobServer(t, 64<<10)
+	test := &ThroughputTest{URL: srv.URL, Streams: 2, Duration: 1, Timeout: 10}
+
+	res := throughputTest(context.Background(), test)
+
+	if res.Error != "" {
+		t.Fatalf("error %s", res.Error)
+	}
+	if res.Incomplete {
+		t.Error("incomplete, the duration being over isn't an interruption")
+	}
+	if res.Bytes == 0 {
+		t.Error("nothing downloaded")
+	}
+	var bytes int64
+	for _, s := range res.StreamResults {
+		if s.Requests <= 1 {
+			t.Errorf("stream %d: %d requests, the blob downloaded over and over expected", s.Stream, s.Requests)
+		}
+		if s.Error != "" {
+			t.Errorf("stream %d: error %s", s.Stream, s.Error)
+		}
+		bytes += s.Bytes
+	}
+	if bytes != res.Bytes {
+		t.Errorf("streams downloaded %d bytes, %d in total", bytes, res.Bytes)
+	}
+	if n := atomic.LoadInt64(requests); n <= int64(test.Streams) {
+		t.Errorf("%d requests", n)
+	}
+}
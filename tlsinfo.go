@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultCertWarnDays = 30
+
+// What we learnt about the TLS connection and certificate of a HTTPS check
+type TLSInfo struct {
+	Version      string    `json:"version"`
+	CipherSuite  string    `json:"cipher_suite"`
+	Subject      string    `json:"subject"`
+	SANs         []string  `json:"sans"`
+	Issuer       string    `json:"issuer"`
+	NotAfter     time.Time `json:"not_after"`
+	DaysToExpiry int       `json:"days_to_expiry"`
+	Verified     bool      `json:"verified"`
+	VerifyError  string    `json:"verify_error,omitempty"`
+	OCSPStapled  bool      `json:"ocsp_stapled"`
+}
+
+// Sent when the certificate of a URL check is about to expire (or did)
+type CertWarning struct {
+	URL          string          `json:"url"`
+	Subject      string          `json:"subject"`
+	Issuer       string          `json:"issuer"`
+	NotAfter     time.Time       `json:"not_after"`
+	DaysToExpiry int             `json:"days_to_expiry"`
+	Threshold    int             `json:"threshold"`
+	Time         time.Time       `json:"time"`
+	Location     *ReportLocation `json:"location"`
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Verified:    len(state.VerifiedChains) > 0,
+		OCSPStapled: len(state.OCSPResponse) > 0,
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return info
+	}
+	leaf := state.PeerCertificates[0]
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.NotAfter = leaf.NotAfter
+	info.DaysToExpiry = int(time.Until(leaf.NotAfter).Hours() / 24)
+	info.SANs = append(info.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+
+	return info
+}
+
+// Handshake with the server of rawurl without verifying its certificate,
+// so we can tell what's wrong with it when a HTTPS check fails.
+//
+// Goes through proxyURL unless empty, with a HEAD request, the proxy
+// certificate being verified as usual. Returns nil for plain HTTP URLs or
+// when the handshake fails.
+func inspectTLS(ctx context.Context, rawurl, proxyURL string) *TLSInfo {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "https" {
+		return nil
+	}
+	host := u.Hostname()
+
+	transport, err := egress.transport(proxyURL)
+	if err != nil {
+		return nil
+	}
+	defer transport.CloseIdleConnections()
+	transport.DisableKeepAlives = true
+	// a HTTPS proxy is the first handshake, the only one verified here
+	proxyHost := ""
+	if p, err := parseProxy(proxyURL); err == nil && p.Scheme == "https" {
+		proxyHost = p.Hostname()
+	}
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if proxyHost == "" {
+				return nil
+			}
+			name := proxyHost
+			proxyHost = ""
+			return verifyPeer(&cs, name)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", rawurl, nil)
+	if err != nil {
+		return nil
+	}
+	// no redirects, it's this server we're after
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.TLS == nil {
+		return nil
+	}
+	resp.Body.Close()
+
+	state := resp.TLS
+	info := newTLSInfo(state)
+
+	if err := verifyPeer(state, host); err != nil {
+		info.VerifyError = err.Error()
+	} else {
+		info.Verified = true
+	}
+
+	return info
+}
+
+// Verify the certificate chain the server sent against the system roots
+func verifyPeer(state *tls.ConnectionState, name string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+// VoIP call quality estimate for the target, using the simplified ITU-T
+// G.107 E-model (Cole and Rosenbluth):
+//
+//   R = 93.2 - Id - Ie-eff
+//
+// The delay impairment Id comes from the one way delay: half the average
+// RTT, plus a jitter buffer twice the jitter and the codec delay. The
+// equipment impairment Ie-eff from the loss and how well the codec copes
+// with it. R is then mapped to a MOS between 1 and 4.5.
+//
+//   "voip": {"codec": "g729a"}
+//
+// Codecs are g711 (default), g711-plc, g729a and g723.1, others can be
+// given their impairment (ITU-T G.113) and delay in milliseconds:
+//
+//   "voip": {"codec": "amr", "ie": 5, "bpl": 10, "delay": 25}
+
+import (
+	"fmt"
+	"math"
+)
+
+type Codec struct {
+	Name string `json:"codec"`
+	// equipment impairment and packet loss robustness
+	Ie  float64 `json:"ie"`
+	Bpl float64 `json:"bpl"`
+	// milliseconds, packetization and look-ahead
+	Delay float64 `json:"delay"`
+}
+
+var codecs = map[string]Codec{
+	"g711":     {Ie: 0, Bpl: 4.3, Delay: 20},
+	"g711-plc": {Ie: 0, Bpl: 25.1, Delay: 20},
+	"g729a":    {Ie: 11, Bpl: 19, Delay: 25},
+	"g723.1":   {Ie: 15, Bpl: 16.1, Delay: 67.5},
+}
+
+type VoIPScore struct {
+	Codec string `json:"codec"`
+	// milliseconds, one way
+	Delay   float64 `json:"delay"`
+	RFactor float64 `json:"r_factor"`
+	MOS     float64 `json:"mos"`
+}
+
+func (c *Codec) validate() error {
+	if c.Name == "" {
+		c.Name = "g711"
+	}
+
+	known, ok := codecs[c.Name]
+	if !ok {
+		if c.Bpl <= 0 {
+			return fmt.Errorf("Unknown codec '%s', ie, bpl and delay required", c.Name)
+		}
+		return nil
+	}
+	if c.Ie == 0 {
+		c.Ie = known.Ie
+	}
+	if c.Bpl == 0 {
+		c.Bpl = known.Bpl
+	}
+	if c.Delay == 0 {
+		c.Delay = known.Delay
+	}
+
+	return nil
+}
+
+// MOS for an R-factor, ITU-T G.107 annex B
+func rFactorToMOS(r float64) float64 {
+	switch {
+	case r <= 0:
+		return 1
+	case r >= 100:
+		return 4.5
+	}
+	// dips slightly below 1 for the lowest values
+	return math.Max(1, 1+0.035*r+r*(r-60)*(100-r)*7e-6)
+}
+
+func voipScore(dest *Host, codec *Codec) *VoIPScore {
+	score := &VoIPScore{Codec: codec.Name}
+
+	score.Delay = dest.Avg/2 + 2*dest.Jitter + codec.Delay
+	id := 0.024 * score.Delay
+	if score.Delay > 177.3 {
+		id += 0.11 * (score.Delay - 177.3)
+	}
+
+	// random loss, no bursts
+	loss := dest.LostPercent
+	ie := codec.Ie + (95-codec.Ie)*loss/(loss+codec.Bpl)
+
+	r := 93.2 - id - ie
+	if r < 0 {
+		r = 0
+	}
+	score.RFactor = r
+	score.MOS = rFactorToMOS(r)
+
+	return score
+}
+
+// The score in the report, computed for g711 when there's none
+func reportVoIP(r *Report) *VoIPScore {
+	if r.VoIP != nil {
+		return r.VoIP
+	}
+	codec := &Codec{}
+	codec.validate()
+	return voipScore(lastHop(r), codec)
+}
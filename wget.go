@@ -1,101 +1,477 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/PuerkitoBio/goquery"
 	log "github.com/Sirupsen/logrus"
-	"github.com/headzoo/surf"
-	"github.com/headzoo/surf/browser"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 type UrlTestResult struct {
-	Location     *ReportLocation `json:"location"`
-	TimeStart    time.Time `json:"time_start"`
-	HTMLTime     int64     `json:"html_time"`
-	TotalTime    int64     `json:"total_time"`
-	Bytes        int64     `json:"bytes"`
-	DownloadDir  string    `json"string"`
-	LinkedAssets int       `json:"linked_assets"`
-	URL          string    `json:"url"`
-}
-
-func downloadAsset(dir string, asset interface{}, ch *browser.AsyncDownloadChannel) error {
-	// we're not interested in the downloaded assets so discard them
-	fout, err := os.Create("/dev/null")
+	Location  *ReportLocation `json:"location"`
+	TimeStart time.Time       `json:"time_start"`
+	HTMLTime  int64           `json:"html_time"`
+	TotalTime int64           `json:"total_time"`
+	Bytes     int64           `json:"bytes"`
+	// only when saving the downloads, see URLCheck.SaveDir
+	DownloadDir  string `json:"download_dir,omitempty"`
+	LinkedAssets int    `json:"linked_assets"`
+	URL          string `json:"url"`
+	// bytes per second, HTML document and assets
+	Throughput   float64 `json:"throughput"`
+	FailedAssets int     `json:"failed_assets"`
+	CutOffAssets int     `json:"cut_off_assets"`
+	HTMLBytes    int64   `json:"html_bytes"`
+	// only when the check has assertions
+	Passed     *bool              `json:"passed,omitempty"`
+	Assertions []*AssertionResult `json:"assertions,omitempty"`
+	Error      string             `json:"error,omitempty"`
+	// cut short by check.Timeout or the deadline of the run, assets not
+	// downloaded yet are missing
+	Incomplete bool `json:"incomplete,omitempty"`
+	// HTTPS only
+	TLS *TLSInfo `json:"tls,omitempty"`
+	// when not the defaults
+	Egress *Egress `json:"egress,omitempty"`
+	// the HTML document
+	Timing *HTTPTiming    `json:"timing"`
+	Assets []*AssetResult `json:"assets,omitempty"`
+}
+
+// Where the time to fetch a URL went, in nanoseconds.
+//
+// Following redirects, the phases refer to the last request sent.
+type HTTPTiming struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code"`
+	Proto      string `json:"proto"`
+	RemoteIP   string `json:"remote_ip"`
+	DNSTime    int64  `json:"dns_time"`
+	Connect    int64  `json:"connect_time"`
+	TLSTime    int64  `json:"tls_time"`
+	// from the start of the request to the first response byte, server
+	// think time is TTFB minus DNS, connect and TLS
+	TTFB     int64 `json:"ttfb"`
+	Transfer int64 `json:"transfer_time"`
+}
+
+type AssetResult struct {
+	*HTTPTiming
+	// image, script or css
+	Type     string `json:"type"`
+	Bytes    int64  `json:"bytes"`
+	Duration int64  `json:"duration"`
+	// bytes per second
+	Throughput float64 `json:"throughput"`
+	Error      string  `json:"error,omitempty"`
+	// timed out or too large
+	CutOff bool `json:"cut_off,omitempty"`
+}
+
+type asset struct {
+	url *url.URL
+	// image, script or css
+	kind string
+}
+
+// Sets the headers configured for a check in the requests to the check
+// host, so credentials never leak to third party asset hosts
+type checkTransport struct {
+	base      *http.Transport
+	host      string
+	headers   http.Header
+	userAgent string
+}
+
+// Lets http.Client.CloseIdleConnections reach the base transport
+func (t *checkTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+func (t *checkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// round trippers must not modify the request
+	req = req.Clone(req.Context())
+	if t.userAgent != "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if req.URL.Host == t.host {
+		for name, values := range t.headers {
+			if name == "Host" {
+				req.Host = values[0]
+				continue
+			}
+			req.Header[name] = values
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func newHTTPClient(check *URLCheck) (*http.Client, error) {
+	u, err := url.Parse(check.URL)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := check.requestHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	jar, _ := cookiejar.New(nil)
+	cookies := []*http.Cookie{}
+	for name, value := range check.Cookies {
+		cookies = append(cookies, &http.Cookie{Name: name, Value: value})
+	}
+	jar.SetCookies(u, cookies)
+
+	base, err := egress.transport(check.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &checkTransport{
+		base:      base,
+		host:      u.Host,
+		headers:   headers,
+		userAgent: check.UserAgent,
+	}
+
+	return &http.Client{Jar: jar, Transport: transport}, nil
+}
+
+// GET u copying the response body to out, timing every phase of the request
+func tracedGet(ctx context.Context, client *http.Client, u string, out io.Writer) (*HTTPTiming, *http.Response, int64, error) {
+	timing := &HTTPTiming{URL: u}
+	// the callbacks may run in dialing goroutines, some even after the
+	// request is done, they only touch these under mu
+	var mu sync.Mutex
+	var start, dnsStart, connectStart, tlsStart, firstByte time.Time
+	phases := HTTPTiming{}
+	locked := func(f func()) {
+		mu.Lock()
+		defer mu.Unlock()
+		f()
+	}
+
+	trace := &httptrace.ClientTrace{
+		// every request of a redirect chain starts here, starting over
+		// keeps the timing of the last one only
+		GetConn: func(string) {
+			locked(func() {
+				start = time.Now()
+				phases = HTTPTiming{}
+			})
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { locked(func() { dnsStart = time.Now() }) },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			locked(func() { phases.DNSTime = time.Since(dnsStart).Nanoseconds() })
+		},
+		ConnectStart: func(_, _ string) { locked(func() { connectStart = time.Now() }) },
+		ConnectDone: func(_, _ string, _ error) {
+			locked(func() { phases.Connect = time.Since(connectStart).Nanoseconds() })
+		},
+		TLSHandshakeStart: func() { locked(func() { tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { phases.TLSTime = time.Since(tlsStart).Nanoseconds() })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr); ok {
+				locked(func() { phases.RemoteIP = addr.IP.String() })
+			}
+		},
+		GotFirstResponseByte: func() { locked(func() { firstByte = time.Now() }) },
+	}
+	// copy of the phases timed so far
+	collect := func() {
+		locked(func() {
+			timing.DNSTime = phases.DNSTime
+			timing.Connect = phases.Connect
+			timing.TLSTime = phases.TLSTime
+			timing.RemoteIP = phases.RemoteIP
+		})
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return timing, nil, 0, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	resp, err := client.Do(req)
+	collect()
+	if err != nil {
+		return timing, nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var requestStart, gotFirstByte time.Time
+	locked(func() { requestStart, gotFirstByte = start, firstByte })
+	timing.StatusCode = resp.StatusCode
+	timing.Proto = resp.Proto
+	timing.TTFB = gotFirstByte.Sub(requestStart).Nanoseconds()
+
+	size, err := io.Copy(out, resp.Body)
+	timing.Transfer = time.Since(gotFirstByte).Nanoseconds()
+
+	return timing, resp, size, err
+}
+
+// Images, scripts and stylesheets linked from the document, relative
+// URLs resolved against base
+func pageAssets(doc *goquery.Document, base *url.URL) []asset {
+	assets := []asset{}
+	add := func(kind, ref string) {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return
+		}
+		assets = append(assets, asset{url: base.ResolveReference(u), kind: kind})
+	}
+
+	doc.Find("img[src]").Each(func(_ int, s *goquery.Selection) {
+		src, _ := s.Attr("src")
+		add("image", src)
+	})
+	doc.Find("script[src]").Each(func(_ int, s *goquery.Selection) {
+		src, _ := s.Attr("src")
+		add("script", src)
+	})
+	doc.Find("link[rel=stylesheet][href]").Each(func(_ int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		add("css", href)
+	})
+
+	return assets
+}
+
+var errAssetTooLarge = errors.New("asset too large")
+
+// Writer counting the bytes written to it before passing them on to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Writer failing once more than max bytes have been written
+type cappedWriter struct {
+	w   io.Writer
+	max int64
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > c.max {
+		n, _ := c.w.Write(p[:c.max])
+		c.max = 0
+		return n, errAssetTooLarge
+	}
+	c.max -= int64(len(p))
+	return c.w.Write(p)
+}
+
+// Bytes per second
+func throughput(bytes, nanoseconds int64) float64 {
+	if nanoseconds <= 0 {
+		return 0
+	}
+	return float64(bytes) / (float64(nanoseconds) / float64(time.Second))
+}
+
+// File name to save u as, flattening the URL path
+func saveName(u *url.URL) string {
+	name := u.Host + u.Path
+	if u.RawQuery != "" {
+		name += "?" + u.RawQuery
+	}
+	return strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_").Replace(name)
+}
+
+// Directory of a run of check under its save dir, every check and every run
+// getting its own
+func runSaveDir(check *URLCheck, start time.Time) (string, error) {
+	u, err := url.Parse(check.URL)
 	if err != nil {
-		return err
+		return "", err
 	}
-	asset.(browser.Downloadable).DownloadAsync(fout, *ch)
+	dir := filepath.Join(check.SaveDir, saveName(u), start.Format("20060102T150405.000"))
+	return dir, os.MkdirAll(dir, 0755)
+}
 
-	return nil
+// Where to write a download: nowhere unless saving them to dir
+func downloadSink(dir, name string) (io.WriteCloser, error) {
+	if dir == "" {
+		return nopWriteCloser{ioutil.Discard}, nil
+	}
+	return os.Create(filepath.Join(dir, name))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func downloadAsset(ctx context.Context, client *http.Client, a asset, check *URLCheck, saveDir string) *AssetResult {
+	result := &AssetResult{HTTPTiming: &HTTPTiming{URL: a.url.String()}, Type: a.kind}
+
+	// we're not interested in the downloaded assets, discard them unless
+	// debugging
+	sink, err := downloadSink(saveDir, saveName(a.url))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer sink.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.AssetTimeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	counter := &countingWriter{w: sink}
+	out := &cappedWriter{w: counter, max: check.MaxAssetBytes}
+	timing, _, _, err := tracedGet(ctx, client, a.url.String(), out)
+	result.HTTPTiming = timing
+	result.Bytes = counter.n
+	result.Duration = time.Since(start).Nanoseconds()
+	result.Throughput = throughput(result.Bytes, result.Duration)
+
+	if errors.Is(err, errAssetTooLarge) || errors.Is(err, context.DeadlineExceeded) {
+		result.CutOff = true
+	}
+	if err == nil && timing.StatusCode >= 400 {
+		err = fmt.Errorf("HTTP status %d", timing.StatusCode)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
 }
 
 // Download an HTML page and the linked assets
 //
-// Setting the downloadDir to an empty string, a temporary directory
-// is created and the assets are downloaded there.
+// Downloads are only counted and discarded, unless check.SaveDir is set:
+// the page and the assets are saved then in a directory of their own for
+// every check and every run, see runSaveDir.
 //
-// Setting clean to true removes downloadDir after the assets have
-// been downloaded.
-func wget(url string, downloadDir string, clean bool) (res UrlTestResult , err error) {
-	bow := surf.NewBrowser()
+// Assets are downloaded by check.Concurrency workers, each one cut off
+// after check.AssetTimeout seconds or check.MaxAssetBytes, and the whole
+// test after check.Timeout seconds or when ctx is done.
+func wget(ctx context.Context, check *URLCheck) (res UrlTestResult, err error) {
+	client, err := newHTTPClient(check)
+	if err != nil {
+		return UrlTestResult{}, err
+	}
+	// every run gets its own transport, don't leave its connections behind
+	defer client.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.Timeout)*time.Second)
+	defer cancel()
 
-	res.URL = url
+	res.URL = check.URL
+	res.Egress = egress.report(check.Proxy)
 	res.TimeStart = time.Now()
 
-	if err = bow.Open(url); err != nil {
+	var page bytes.Buffer
+	timing, resp, size, err := tracedGet(ctx, client, check.URL, &cappedWriter{w: &page, max: check.MaxBytes})
+	if errors.Is(err, errAssetTooLarge) {
+		return UrlTestResult{}, fmt.Errorf("Error opening URL: page larger than %d bytes\n", check.MaxBytes)
+	}
+	if err != nil {
 		return UrlTestResult{}, fmt.Errorf("Error opening URL: %s\n", err)
 	}
+	res.Timing = timing
+	res.HTMLBytes = size
+	if resp.TLS != nil {
+		res.TLS = newTLSInfo(resp.TLS)
+	}
+	body := page.Bytes()
 
 	// time it takes to download the HTML
 	res.HTMLTime = time.Since(res.TimeStart).Nanoseconds()
 
-	images := bow.Images()
-	css := bow.Stylesheets()
-	scripts := bow.Scripts()
-	downloadChannel := make(browser.AsyncDownloadChannel, 1)
-	res.LinkedAssets = len(images) + len(css) + len(scripts)
-
-	if downloadDir == "" {
-		if res.DownloadDir, err = ioutil.TempDir(downloadDir, ""); err != nil {
-			return UrlTestResult{}, fmt.Errorf("Wget: Error creating tempdir: %s\n", err)
-		}
-		if clean {
-			defer os.RemoveAll(res.DownloadDir)
-		}
-	} else {
-		res.DownloadDir = downloadDir
+	doc, err := goquery.NewDocumentFromReader(&page)
+	if err != nil {
+		return UrlTestResult{}, fmt.Errorf("Error parsing HTML: %s\n", err)
 	}
+	// relative to the URL we've been redirected to, if any
+	assets := pageAssets(doc, resp.Request.URL)
+	res.LinkedAssets = len(assets)
 
-	for _, asset := range images {
-		downloadAsset(res.DownloadDir, asset, &downloadChannel)
+	saveDir := ""
+	if check.SaveDir != "" {
+		if dir, err := runSaveDir(check, res.TimeStart); err != nil {
+			log.Warnf("Error saving %s: %s", check.URL, err)
+		} else {
+			saveDir = dir
+			res.DownloadDir = dir
+			if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), body, 0644); err != nil {
+				log.Warnf("Error saving %s: %s", check.URL, err)
+			}
+		}
 	}
 
-	for _, asset := range scripts {
-		downloadAsset(res.DownloadDir, asset, &downloadChannel)
+	// both buffered so workers never block, even if the test times out
+	jobs := make(chan asset, len(assets))
+	results := make(chan *AssetResult, len(assets))
+	for _, asset := range assets {
+		jobs <- asset
 	}
-
-	for _, asset := range css {
-		downloadAsset(res.DownloadDir, asset, &downloadChannel)
+	close(jobs)
+	for i := 0; i < check.Concurrency; i++ {
+		go func() {
+			for asset := range jobs {
+				results <- downloadAsset(ctx, client, asset, check, saveDir)
+			}
+		}()
 	}
 
 	// Now we wait for each download to complete.
 	for i := 0; i < res.LinkedAssets; i++ {
-		result := <-downloadChannel
-		if result.Error != nil {
-			log.Errorf("Error download '%s'. %s\n", result.Asset.Url(), result.Error)
-		} else {
-			log.Debugf("Downloaded '%s'.\n", result.Asset.Url())
+		result := <-results
+		switch {
+		case result.CutOff:
+			log.Warnf("Download of '%s' cut off. %s\n", result.URL, result.Error)
+			res.CutOffAssets++
+			res.Bytes += result.Bytes
+		case result.Error != "":
+			log.Errorf("Error download '%s'. %s\n", result.URL, result.Error)
+			res.FailedAssets++
+		default:
+			log.Debugf("Downloaded '%s'.\n", result.URL)
+			res.Bytes += result.Bytes
 		}
-		res.Bytes += result.Size
+		res.Assets = append(res.Assets, result)
 	}
 
 	res.TotalTime = time.Since(res.TimeStart).Nanoseconds()
+	res.Incomplete = ctx.Err() != nil
+	res.Throughput = throughput(res.HTMLBytes+res.Bytes, res.TotalTime)
+	if check.Assert != nil {
+		check.Assert.check(&res, resp, body)
+	}
 	log.Debugf("Total time: %0.3f\n", float64(res.TotalTime)/float64(time.Second))
 	log.Debugf("Assets downloaded: %d", res.LinkedAssets)
-	log.Debugf("Time to URL %s, %0.3f\n", url, float64(res.HTMLTime)/float64(time.Second))
+	log.Debugf("Time to URL %s, %0.3f\n", check.URL, float64(res.HTMLTime)/float64(time.Second))
 
 	return res, nil
 }